@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+	"github.com/lcpu-club/kube-auth-proxy/internal/login"
 	"github.com/lcpu-club/kube-auth-proxy/internal/server"
 )
 
@@ -21,22 +22,61 @@ func determineEndpointFromEnv() string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "login" {
+		err := login.Run(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	conf := &config.ServerConfig{}
 	conf.Listen = flag.String("listen", ":8080", "Listen address")
 	conf.Upstream = flag.String("upstream", determineEndpointFromEnv(), "Upstream address")
 	conf.Storage = flag.String("storage", "memory:", "Token storage type")
 	conf.UIDistPath = flag.String("ui-dist-path", "/ui-dist", "Path to the UI distribution")
 	conf.KubeSecretPath = flag.String("kube-secret-path", "/var/run/secrets/kubernetes.io/serviceaccount", "Path to the Kubernetes service account token")
+	conf.OAuthProvidersFile = flag.String("oauth-providers-file", "", "JSON file listing login providers (overrides the single-provider -oauth-* flags)")
+	conf.OAuthProvider = flag.String("oauth-provider", "hpcgame", "OAuth provider type (hpcgame, oidc, none)")
 	conf.OAuthAppID = flag.String("oauth-app-id", os.Getenv("OAUTH_APP_ID"), "OAuth App ID")
 	conf.OAuthSecret = flag.String("oauth-secret", os.Getenv("OAUTH_SECRET"), "OAuth App Secret")
 	conf.OAuthCallback = flag.String("oauth-callback", "http://localhost:8080/_/oauth/callback", "OAuth Callback URL")
 	conf.OAuthDefaultGroup = flag.String("oauth-default-group", "hpcgame:competitors", "Default group for OAuth users")
+	conf.OAuthGroupRulesFile = flag.String("oauth-group-rules-file", "", "JSON file with rules mapping user profile fields to groups and extras")
+	conf.CookieSecret = flag.String("cookie-secret", os.Getenv("COOKIE_SECRET"), "Secret used to sign cookies (random if empty; must be shared between replicas)")
+	conf.SessionExpiration = flag.Duration("session-expiration", 24*time.Hour, "Browser session expiration time, for providers that issue no refresh token")
+	conf.ExtrasAllow = flag.String("extras-allow", "name,school,studentGrade", "Comma-separated user info fields forwarded as impersonation extras")
+	conf.ExtrasHash = flag.String("extras-hash", "", "Comma-separated user info fields forwarded only as salted SHA-256 hashes")
+	conf.ExtrasHashSalt = flag.String("extras-hash-salt", os.Getenv("EXTRAS_HASH_SALT"), "Salt (HMAC key) used when hashing extras")
+	conf.OAuthJWKSURL = flag.String("oauth-jwks-url", os.Getenv("OAUTH_JWKS_URL"), "JWKS URL used to verify OAuth access tokens locally (defaults to the OIDC jwks_uri)")
+	conf.OAuthJWKSRefresh = flag.Duration("oauth-jwks-refresh", time.Hour, "JWKS refresh interval")
+	conf.OAuthIssuer = flag.String("oauth-issuer", "", "Expected iss claim of OAuth access tokens (defaults to the OIDC issuer)")
+	conf.OAuthAudience = flag.String("oauth-audience", "", "Expected aud claim of OAuth access tokens (empty to skip the check)")
+	conf.OAuthVerifyJWT = flag.Bool("oauth-verify-jwt", true, "Verify OAuth access tokens as JWTs (disable for providers issuing opaque tokens; hpcgame then trusts tokens unverified)")
+	conf.OIDCIssuer = flag.String("oidc-issuer", "", "OIDC issuer URL, used for discovery")
+	conf.OIDCScopes = flag.String("oidc-scopes", "openid,profile,email", "Comma-separated OIDC scopes to request")
+	conf.OIDCClaims = flag.String("oidc-claims", "id=sub,name=preferred_username,email=email,realname=name", "Comma-separated mapping of user info fields to OIDC claims")
+	conf.IdentityCache = flag.String("identity-cache", "memory", "OAuth identity cache backend (memory, storage, none)")
+	conf.IdentityCacheTTL = flag.Duration("identity-cache-ttl", time.Minute, "How long cached OAuth identities are considered fresh")
+	conf.IdentityCacheStale = flag.Duration("identity-cache-stale", 10*time.Minute, "How long past the TTL cached identities may be served while the provider is failing")
+	conf.TokenAuthFile = flag.String("token-auth-file", "", "CSV file of static tokens (token,user,uid,\"group1,group2\"), reloaded on change")
+	conf.AnonymousPolicy = flag.String("anonymous", "allow", "Requests without credentials: allow, deny, or paths to allow only -anonymous-paths")
+	conf.AnonymousPaths = flag.String("anonymous-paths", "/version,/healthz,/livez,/readyz", "Comma-separated paths allowed without credentials, a trailing * matches a prefix")
+	conf.AdminGroup = flag.String("admin-group", "", "Group whose members may act as other users with the X-Kube-Auth-Proxy-Act-As header (empty to disable)")
+	conf.AuditLog = flag.String("audit-log", "", "File to append the audit log to (stderr if empty)")
+	conf.ServiceAccountTokens = flag.String("serviceaccount-tokens", "off", "In-cluster ServiceAccount tokens: off, passthrough, or impersonate the owner of u-<username> namespaces")
+	conf.TokenReview = flag.Bool("tokenreview", false, "Serve /_/tokenreview for the apiserver's webhook token authenticator")
+	conf.TokenReviewClients = flag.String("tokenreview-clients", "", "Comma-separated client certificate or token file users allowed to call /_/tokenreview (empty to allow any verified client certificate, which needs a CA dedicated to webhook callers)")
 	conf.TokenExpiration = flag.Duration("token-expiration", 14*24*time.Hour, "Token expiration time")
+	conf.TokenExpirationMax = flag.String("token-expiration-max", "", "Comma-separated group=duration caps on requested token lifetimes, * for everyone else (default: -token-expiration)")
+	conf.TokenRotationGrace = flag.Duration("token-rotation-grace", 24*time.Hour, "How long the old secret of a rotated token keeps working")
 	conf.TokenLength = flag.Int("token-length", 36, "Token length")
 	conf.TokenCountMax = flag.Int("token-count-max", 128, "Maximum number of tokens per user")
 	conf.TLSCertFile = flag.String("tls-cert-file", "", "TLS certificate file (empty to disable TLS)")
 	conf.TLSKeyFile = flag.String("tls-key-file", "", "TLS key file (empty to disable TLS)")
+	conf.TLSClientCAFile = flag.String("tls-client-ca-file", "", "CA bundle used to verify client certificates (empty to disable client certificate authentication)")
 	conf.KubeconfigTemplatePath = flag.String("kubeconfig-template-path", "kubeconfig.tmpl", "Path to the kubeconfig template file")
+	conf.KubeconfigExecTemplatePath = flag.String("kubeconfig-exec-template-path", "", "Path to the kubeconfig template using the login exec plugin (empty to disable /_/kubeconfig)")
 
 	flag.Parse()
 
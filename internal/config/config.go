@@ -10,18 +10,60 @@ type ServerConfig struct {
 
 	KubeSecretPath *string
 
+	OAuthProvidersFile *string
+
+	OAuthProvider *string
 	OAuthCallback *string
 	OAuthAppID    *string
 	OAuthSecret   *string
 
-	OAuthDefaultGroup *string
+	OAuthDefaultGroup   *string
+	OAuthGroupRulesFile *string
+
+	CookieSecret      *string
+	SessionExpiration *time.Duration
+
+	ExtrasAllow    *string
+	ExtrasHash     *string
+	ExtrasHashSalt *string
+
+	OAuthJWKSURL     *string
+	OAuthJWKSRefresh *time.Duration
+	OAuthIssuer      *string
+	OAuthAudience    *string
+	OAuthVerifyJWT   *bool
+
+	OIDCIssuer *string
+	OIDCScopes *string
+	OIDCClaims *string
+
+	IdentityCache      *string
+	IdentityCacheTTL   *time.Duration
+	IdentityCacheStale *time.Duration
+
+	TokenAuthFile *string
+
+	AnonymousPolicy *string
+	AnonymousPaths  *string
+
+	AdminGroup *string
+	AuditLog   *string
+
+	ServiceAccountTokens *string
+
+	TokenReview        *bool
+	TokenReviewClients *string
 
-	TokenExpiration *time.Duration
-	TokenLength     *int
-	TokenCountMax   *int
+	TokenExpiration    *time.Duration
+	TokenExpirationMax *string
+	TokenRotationGrace *time.Duration
+	TokenLength        *int
+	TokenCountMax      *int
 
-	TLSCertFile *string
-	TLSKeyFile  *string
+	TLSCertFile     *string
+	TLSKeyFile      *string
+	TLSClientCAFile *string
 
-	KubeconfigTemplatePath *string
+	KubeconfigTemplatePath     *string
+	KubeconfigExecTemplatePath *string
 }
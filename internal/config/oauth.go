@@ -0,0 +1,162 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type OAuthProviderConfig struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	Callback     string `json:"callback"`
+
+	// Prefix namespaces identities from this provider, users become
+	// "<prefix>:<id>" with UID "<prefix>-<id>"
+	Prefix       string `json:"prefix"`
+	DefaultGroup string `json:"defaultGroup"`
+	Claims       string `json:"claims"`
+
+	Issuer string   `json:"issuer"`
+	Scopes []string `json:"scopes"`
+
+	JWKSURL     string        `json:"jwksUrl"`
+	JWKSRefresh time.Duration `json:"-"`
+	TokenIssuer string        `json:"tokenIssuer"`
+	Audience    string        `json:"audience"`
+	VerifyJWT   *bool         `json:"verifyJwt"`
+
+	GroupRules []*GroupRule `json:"groupRules"`
+}
+
+// GroupRule grants groups and extras to users whose profile field matches
+type GroupRule struct {
+	Field string `json:"field"`
+	// Match is one of equals (default), contains, prefix, suffix, regex or exists
+	Match  string            `json:"match"`
+	Value  string            `json:"value"`
+	Groups []string          `json:"groups"`
+	Extra  map[string]string `json:"extra"`
+}
+
+func splitList(s string) []string {
+	rslt := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			rslt = append(rslt, v)
+		}
+	}
+	return rslt
+}
+
+// LoadGroupRules reads the global group rules file, if any
+func (c *ServerConfig) LoadGroupRules() ([]*GroupRule, error) {
+	if *c.OAuthGroupRulesFile == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(*c.OAuthGroupRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []*GroupRule{}
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// validPrefix keeps prefixed UIDs valid DNS subdomains and free of "-",
+// which separates the prefix from the provider's user id
+var validPrefix = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// LoadOAuthProviders reads the providers file, or builds a single provider
+// from the legacy command line flags when no file is configured
+func (c *ServerConfig) LoadOAuthProviders() ([]*OAuthProviderConfig, error) {
+	if *c.OAuthProvidersFile == "" {
+		if *c.OAuthProvider == "none" {
+			return nil, nil
+		}
+		claims := ""
+		if *c.OAuthProvider == "oidc" {
+			claims = *c.OIDCClaims
+		}
+		return []*OAuthProviderConfig{{
+			Name:         *c.OAuthProvider,
+			Type:         *c.OAuthProvider,
+			ClientID:     *c.OAuthAppID,
+			ClientSecret: *c.OAuthSecret,
+			Callback:     *c.OAuthCallback,
+			DefaultGroup: *c.OAuthDefaultGroup,
+			Claims:       claims,
+			Issuer:       *c.OIDCIssuer,
+			Scopes:       splitList(*c.OIDCScopes),
+			JWKSURL:      *c.OAuthJWKSURL,
+			JWKSRefresh:  *c.OAuthJWKSRefresh,
+			TokenIssuer:  *c.OAuthIssuer,
+			Audience:     *c.OAuthAudience,
+			VerifyJWT:    c.OAuthVerifyJWT,
+		}}, nil
+	}
+
+	b, err := os.ReadFile(*c.OAuthProvidersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := []*OAuthProviderConfig{}
+	err = json.Unmarshal(b, &providers)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for _, p := range providers {
+		if p.Name == "" || p.Name == "sk" || strings.ContainsAny(p.Name, ":/") {
+			return nil, fmt.Errorf("invalid oauth provider name %q", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate oauth provider %q", p.Name)
+		}
+		names[p.Name] = true
+
+		// Identities from different providers must never collide
+		if len(providers) > 1 && p.Prefix == "" {
+			return nil, fmt.Errorf("oauth provider %q needs a prefix when several providers are configured", p.Name)
+		}
+		if p.Prefix != "" && !validPrefix.MatchString(p.Prefix) {
+			return nil, fmt.Errorf("invalid prefix %q for oauth provider %q", p.Prefix, p.Name)
+		}
+		if prefixes[p.Prefix] {
+			return nil, fmt.Errorf("duplicate prefix %q for oauth provider %q", p.Prefix, p.Name)
+		}
+		prefixes[p.Prefix] = true
+
+		if p.Type == "" {
+			p.Type = p.Name
+		}
+		if p.Callback == "" {
+			return nil, fmt.Errorf("oauth provider %q has no callback url", p.Name)
+		}
+		if p.DefaultGroup == "" {
+			p.DefaultGroup = *c.OAuthDefaultGroup
+		}
+		if p.Scopes == nil {
+			p.Scopes = splitList(*c.OIDCScopes)
+		}
+		if p.VerifyJWT == nil {
+			p.VerifyJWT = c.OAuthVerifyJWT
+		}
+		p.JWKSRefresh = *c.OAuthJWKSRefresh
+	}
+
+	return providers, nil
+}
@@ -0,0 +1,301 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthenticationv1 "k8s.io/client-go/pkg/apis/clientauthentication/v1"
+)
+
+const loginTimeout = 5 * time.Minute
+
+// Cached credentials are renewed this long before they expire
+const expiryMargin = 5 * time.Minute
+
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Run implements the login subcommand, a kubectl exec credential plugin
+// which obtains an sk: token through the browser and caches it locally
+func Run(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	server := fs.String("server", "", "URL of the kube-auth-proxy")
+	provider := fs.String("provider", "", "Login provider (empty for the default provider)")
+	cacheDir := fs.String("cache-dir", defaultCacheDir(), "Directory for cached credentials")
+	noBrowser := fs.Bool("no-browser", false, "Print the login URL instead of opening a browser")
+	force := fs.Bool("force", false, "Ignore cached credentials")
+	device := fs.Bool("device", false, "Log in with a code entered on another device, for terminals without a browser or hosts shared with other users")
+	fs.Parse(args)
+
+	if *server == "" {
+		return errors.New("-server is required")
+	}
+	base := strings.TrimSuffix(*server, "/")
+
+	cachePath := filepath.Join(*cacheDir, utils.HashToken(base + "|" + *provider)[:16]+".json")
+	if !*force {
+		cred, err := loadCachedCredential(cachePath)
+		if err == nil {
+			return printCredential(cred)
+		}
+	}
+
+	var tr *tokenResponse
+	var err error
+	if *device {
+		tr, err = deviceLogin(base)
+	} else {
+		tr, err = browserLogin(base, *provider, *noBrowser)
+	}
+	if err != nil {
+		return err
+	}
+
+	cred := &clientauthenticationv1.ExecCredential{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: clientauthenticationv1.SchemeGroupVersion.String(),
+			Kind:       "ExecCredential",
+		},
+		Status: &clientauthenticationv1.ExecCredentialStatus{
+			Token:               tr.Token,
+			ExpirationTimestamp: &metav1.Time{Time: tr.ExpiresAt},
+		},
+	}
+
+	err = saveCachedCredential(cachePath, cred)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: failed to cache credential:", err)
+	}
+
+	return printCredential(cred)
+}
+
+func defaultCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "kube-auth-proxy")
+	}
+	return filepath.Join(home, ".kube", "cache", "kube-auth-proxy")
+}
+
+func loadCachedCredential(path string) (*clientauthenticationv1.ExecCredential, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &clientauthenticationv1.ExecCredential{}
+	err = json.Unmarshal(b, cred)
+	if err != nil {
+		return nil, err
+	}
+
+	if cred.Status == nil || cred.Status.Token == "" || cred.Status.ExpirationTimestamp == nil {
+		return nil, errors.New("invalid cached credential")
+	}
+	if time.Until(cred.Status.ExpirationTimestamp.Time) < expiryMargin {
+		return nil, errors.New("cached credential expired")
+	}
+
+	return cred, nil
+}
+
+func saveCachedCredential(path string, cred *clientauthenticationv1.ExecCredential) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+func printCredential(cred *clientauthenticationv1.ExecCredential) error {
+	return json.NewEncoder(os.Stdout).Encode(cred)
+}
+
+// browserLogin runs the OAuth flow in a browser and receives a one-time
+// code on a loopback listener, which is then exchanged for a token
+func browserLogin(base string, provider string, noBrowser bool) (*tokenResponse, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	state := utils.GenRandomStateString()
+	redirect := fmt.Sprintf("http://%s/callback", listener.Addr().String())
+
+	redirectPath := "/_/oauth/redirect"
+	if provider != "" {
+		redirectPath = "/_/oauth/" + url.PathEscape(provider) + "/redirect"
+	}
+	loginURL := base + redirectPath + "?" + url.Values{
+		"cli_redirect": {redirect},
+		"cli_state":    {state},
+	}.Encode()
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Query().Get("state") != state {
+				http.Error(w, "State mismatch", http.StatusBadRequest)
+				select {
+				case errCh <- errors.New("login state mismatch"):
+				default:
+				}
+				return
+			}
+			w.Write([]byte("Login succeeded, you may close this window.\n"))
+			select {
+			case codeCh <- r.URL.Query().Get("code"):
+			default:
+			}
+		}),
+	}
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+
+	fmt.Fprintln(os.Stderr, "Open the following URL to log in:")
+	fmt.Fprintln(os.Stderr, loginURL)
+	if !noBrowser {
+		err = openBrowser(loginURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open browser:", err)
+		}
+	}
+
+	var code string
+	select {
+	case code = <-codeCh:
+	case err = <-errCh:
+		return nil, err
+	case <-time.After(loginTimeout):
+		return nil, errors.New("timed out waiting for login")
+	}
+
+	resp, err := http.PostForm(base+"/_/cli/token", url.Values{"code": {code}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to exchange login code: %s", resp.Status)
+	}
+
+	tr := &tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(tr)
+	if err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// deviceLogin runs the device authorization grant, the user approves the
+// printed code in a browser on any other device
+func deviceLogin(base string) (*tokenResponse, error) {
+	resp, err := http.Post(base+"/_/device/code", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to start device login: %s", resp.Status)
+	}
+
+	dc := struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&dc)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintln(os.Stderr, "Open the following URL on any device and enter code", dc.UserCode+":")
+	fmt.Fprintln(os.Stderr, dc.VerificationURIComplete)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		resp, err := http.PostForm(base+"/_/device/token", url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {dc.DeviceCode},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		tr := struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+			Error       string `json:"error"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&tr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tr.Error {
+		case "":
+			return &tokenResponse{
+				Token:     tr.AccessToken,
+				ExpiresAt: time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+			}, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("device login failed: %s", tr.Error)
+		}
+	}
+
+	return nil, errors.New("timed out waiting for device login")
+}
+
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Start()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const actAsHeader = "X-Kube-Auth-Proxy-Act-As"
+
+var ErrActAsForbidden = errors.New("acting as another user requires the admin group")
+var ErrActAsTargetNotFound = errors.New("act-as target not found")
+
+func (s *Server) isAdmin(ii *ImpersonateInfo) bool {
+	return *s.conf.AdminGroup != "" && slices.Contains(ii.Group, *s.conf.AdminGroup)
+}
+
+// loadUserImpersonateInfo loads the identity of a user, from the User
+// object if there is one, else from any of the user's stored tokens
+func (s *Server) loadUserImpersonateInfo(uid string) (*ImpersonateInfo, error) {
+	u, err := s.kubeGetUser(uid)
+	if err == nil {
+		return userToImpersonateInfo(u), nil
+	}
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+
+	tokens, err := s.listTokens(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		rec, err := s.loadTokenRecord(token)
+		if err == nil {
+			return rec.ImpersonateInfo, nil
+		}
+	}
+	return nil, ErrActAsTargetNotFound
+}
+
+// actAs swaps the identity of an admin for the one named in the act-as
+// header, recording both in the audit log; the header never goes upstream
+func (s *Server) actAs(r *http.Request, ii *ImpersonateInfo) (*ImpersonateInfo, error) {
+	uid := r.Header.Get(actAsHeader)
+	r.Header.Del(actAsHeader)
+	if uid == "" {
+		return ii, nil
+	}
+
+	ev := &auditEvent{
+		Action:     "act-as",
+		Actor:      *newAuditIdentity(ii),
+		Target:     &auditIdentity{UID: uid},
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	if !s.isAdmin(ii) {
+		ev.Detail = "denied"
+		s.audit.Write(ev)
+		return nil, ErrActAsForbidden
+	}
+
+	target, err := s.loadUserImpersonateInfo(uid)
+	if err != nil {
+		ev.Detail = err.Error()
+		s.audit.Write(ev)
+		return nil, err
+	}
+
+	ev.Target = newAuditIdentity(target)
+	s.audit.Write(ev)
+	return target, nil
+}
+
+func writeActAsError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrActAsForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrActAsTargetNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to load act-as target", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+func (s *Server) initAdmin() {
+	s.mux.HandleFunc("/_/admin/users/", s.handleAdminUser)
+}
+
+// handleAdminUser serves /_/admin/users/<uid>/tokens[/<id>[/action]], the
+// token API of another user for members of the admin group. Every call is
+// audited.
+func (s *Server) handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	admin, _, ok := s.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	if !s.isAdmin(admin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	uid, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/_/admin/users/"), "/")
+	if uid == "" || (path != "tokens" && !strings.HasPrefix(path, "tokens/")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.audit.Write(&auditEvent{
+		Action:     "manage-tokens",
+		Actor:      *newAuditIdentity(admin),
+		Target:     &auditIdentity{UID: uid},
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+	})
+
+	s.serveTokens(w, r, nil, uid, strings.TrimPrefix(path, "tokens"))
+}
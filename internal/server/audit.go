@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog writes one JSON object per line for privileged actions
+type auditLog struct {
+	w    io.Writer
+	lock *sync.Mutex
+}
+
+type auditIdentity struct {
+	UID      string   `json:"uid,omitempty"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type auditEvent struct {
+	Time       time.Time      `json:"time"`
+	Action     string         `json:"action"`
+	Actor      auditIdentity  `json:"actor"`
+	Target     *auditIdentity `json:"target,omitempty"`
+	Method     string         `json:"method,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	RemoteAddr string         `json:"remoteAddr,omitempty"`
+	Detail     string         `json:"detail,omitempty"`
+}
+
+// newAuditLog appends to path, or writes to stderr if path is empty
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{w: os.Stderr, lock: &sync.Mutex{}}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.w = f
+	}
+	return a, nil
+}
+
+func newAuditIdentity(ii *ImpersonateInfo) *auditIdentity {
+	return &auditIdentity{
+		UID:      ii.UID,
+		Username: ii.Username,
+		Groups:   ii.Group,
+	}
+}
+
+func (a *auditLog) Write(ev *auditEvent) {
+	ev.Time = time.Now()
+	b, err := json.Marshal(ev)
+	if err != nil {
+		panic(err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.w.Write(append(b, '\n'))
+	if err != nil {
+		log.Println("Failed to write audit log:", err)
+	}
+}
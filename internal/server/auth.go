@@ -2,9 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
 )
 
 var anonymousImpersonateInfo = &ImpersonateInfo{
@@ -12,19 +15,129 @@ var anonymousImpersonateInfo = &ImpersonateInfo{
 	Group:    []string{"system:unauthenticated"},
 }
 
+var ErrAuthenticationRequired = errors.New("authentication required")
+
+const (
+	anonymousAllow = "allow"
+	anonymousDeny  = "deny"
+	anonymousPaths = "paths"
+)
+
+// anonymousPolicy decides which requests without credentials are served
+// as system:anonymous
+type anonymousPolicy struct {
+	mode  string
+	paths []string
+}
+
+func newAnonymousPolicy(conf *config.ServerConfig) (*anonymousPolicy, error) {
+	p := &anonymousPolicy{mode: *conf.AnonymousPolicy}
+	switch p.mode {
+	case anonymousAllow, anonymousDeny:
+	case anonymousPaths:
+		for _, path := range strings.Split(*conf.AnonymousPaths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				p.paths = append(p.paths, path)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown anonymous policy %q", p.mode)
+	}
+	return p, nil
+}
+
+// Allows matches paths exactly, or by prefix for entries ending in "*"
+func (p *anonymousPolicy) Allows(path string) bool {
+	switch p.mode {
+	case anonymousAllow:
+		return true
+	case anonymousDeny:
+		return false
+	}
+	for _, allowed := range p.paths {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// writeUnauthorized responds with 401 and a WWW-Authenticate challenge,
+// flagging presented credentials that were rejected as invalid_token.
+// Banned users get 403 with the reason instead.
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	be := &BannedError{}
+	if errors.As(err, &be) {
+		http.Error(w, be.Error(), http.StatusForbidden)
+		return
+	}
+
+	challenge := `Bearer realm="kube-auth-proxy"`
+	if err != ErrAuthenticationRequired {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// clientCertImpersonateInfo maps a verified client certificate to an
+// identity the same way the apiserver does: CN is the user, O the groups
+func clientCertImpersonateInfo(req *http.Request) *ImpersonateInfo {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil
+	}
+
+	return &ImpersonateInfo{
+		Username: cert.Subject.CommonName,
+		Group:    append([]string{}, cert.Subject.Organization...),
+	}
+}
+
 func (s *Server) authenticate(req *http.Request) (*ImpersonateInfo, error) {
+	ii, err := s.authenticateRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkBan(ii)
+	if err != nil {
+		return nil, err
+	}
+	return ii, nil
+}
+
+func (s *Server) authenticateRequest(req *http.Request) (*ImpersonateInfo, error) {
+	if ii := clientCertImpersonateInfo(req); ii != nil {
+		return ii, nil
+	}
+
 	token := req.Header.Get("Authorization")
 	if token == "" {
+		if cookie, err := req.Cookie(sessionCookie); err == nil {
+			return s.authenticateSession(req, cookie)
+		}
+
 		// Check if the request is WebSocket
 		if strings.ToLower(req.Header.Get("Upgrade")) == "websocket" {
 			// Read the token from the query string
 			token = req.URL.Query().Get("auth")
-			if !strings.HasPrefix(token, "Bearer ") {
+			if token != "" && !strings.HasPrefix(token, "Bearer ") {
 				token = "Bearer " + token
 			}
 		}
 
 		if token == "" {
+			if !s.anonymous.Allows(req.URL.Path) {
+				return nil, ErrAuthenticationRequired
+			}
 			return anonymousImpersonateInfo, nil
 		}
 	}
@@ -33,28 +146,73 @@ func (s *Server) authenticate(req *http.Request) (*ImpersonateInfo, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
-	token = token[7:]
+	return s.authenticateToken(token[7:])
+}
+
+// authenticateToken resolves a bearer token, without the "Bearer " prefix
+func (s *Server) authenticateToken(token string) (*ImpersonateInfo, error) {
+	// Static token file
+	if s.tokenFile != nil {
+		if ii, ok := s.tokenFile.Lookup(token); ok {
+			return ii, nil
+		}
+	}
 
 	// SK token
 	if strings.HasPrefix(token, "sk:") {
 		return s.getToken(token)
 	}
 
+	// In-cluster ServiceAccount token
+	if *s.conf.ServiceAccountTokens != serviceAccountTokensOff && isServiceAccountToken(token) {
+		return s.authenticateServiceAccount(token)
+	}
+
 	// OAuth token
-	oi, err := s.getOAuthUserInfo(token)
+	p, token := s.resolveOAuthToken(token)
+	if p == nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	oi, err := s.getOAuthUserInfo(p, token)
 	if err != nil {
 		return nil, err
 	}
 	if oi.ID == "" || oi.Name == "" {
 		return nil, fmt.Errorf("invalid token")
 	}
-	return s.userInfoToImpersonateInfo(oi), nil
+	return s.userInfoToImpersonateInfo(p, oi), nil
+}
+
+// authenticateUser authenticates a request that acts on behalf of a user,
+// which anonymous requests never do, and returns the user's storage UID
+func (s *Server) authenticateUser(w http.ResponseWriter, r *http.Request) (*ImpersonateInfo, string, bool) {
+	ii, err := s.authenticate(r)
+	if err == nil && ii == anonymousImpersonateInfo {
+		err = ErrAuthenticationRequired
+	}
+	if err != nil {
+		writeUnauthorized(w, err)
+		return nil, "", false
+	}
+	if ii.scope != nil {
+		http.Error(w, ErrScopedToken.Error(), http.StatusForbidden)
+		return nil, "", false
+	}
+
+	return ii, impersonateInfoUID(ii), true
 }
 
 func (s *Server) handleWhoAmI(w http.ResponseWriter, r *http.Request) {
 	ii, err := s.authenticate(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeUnauthorized(w, err)
+		return
+	}
+	actor := ii
+
+	ii, err = s.actAs(r, ii)
+	if err != nil {
+		writeActAsError(w, err)
 		return
 	}
 
@@ -64,6 +222,10 @@ func (s *Server) handleWhoAmI(w http.ResponseWriter, r *http.Request) {
 	resp["group"] = ii.Group
 	resp["extra"] = ii.Extra
 	resp["uid"] = ii.UID
+	resp["admin"] = s.isAdmin(actor)
+	if ii != actor {
+		resp["actor"] = actor.Username
+	}
 
 	respStr, err := json.Marshal(resp)
 	if err != nil {
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const banPrefix = "ban:"
+
+type ban struct {
+	Reason   string    `json:"reason"`
+	BannedBy string    `json:"bannedBy"`
+	BannedAt time.Time `json:"bannedAt"`
+}
+
+// BannedError is returned by authenticate for banned users
+type BannedError struct {
+	Reason string
+}
+
+func (e *BannedError) Error() string {
+	if e.Reason == "" {
+		return "user is banned"
+	}
+	return "user is banned: " + e.Reason
+}
+
+func (s *Server) initBan() {
+	s.mux.HandleFunc("/_/admin/bans", s.handleBans)
+	s.mux.HandleFunc("/_/admin/bans/", s.handleBans)
+}
+
+func impersonateInfoUID(ii *ImpersonateInfo) string {
+	if ii.UID != "" {
+		return ii.UID
+	}
+	return ii.Username
+}
+
+func (s *Server) loadBan(uid string) (*ban, error) {
+	v, err := s.stor.Load(banPrefix + uid)
+	if err != nil {
+		return nil, err
+	}
+	b := &ban{}
+	err = json.Unmarshal([]byte(v), b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkBan rejects identities on the ban list
+func (s *Server) checkBan(ii *ImpersonateInfo) error {
+	if ii == anonymousImpersonateInfo {
+		return nil
+	}
+	b, err := s.loadBan(impersonateInfoUID(ii))
+	if err == ErrTokenNotFound {
+		return nil
+	}
+	if err != nil {
+		// Fail closed, the ban list cannot be consulted
+		log.Println("Failed to check ban list:", err)
+		return &BannedError{Reason: "ban list unavailable"}
+	}
+	return &BannedError{Reason: b.Reason}
+}
+
+// revokeUser deletes every sk: token and session of the user
+func (s *Server) revokeUser(uid string) error {
+	tokens, err := s.listTokens(uid)
+	if err != nil {
+		return err
+	}
+	sessions, err := s.listUserKeys(sessionPrefix, uid)
+	if err != nil {
+		return err
+	}
+	for _, key := range append(tokens, sessions...) {
+		err = s.stor.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	admin, _, ok := s.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	if !s.isAdmin(admin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	uid := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_/admin/bans"), "/")
+	if uid == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleListBans(w)
+		return
+	}
+
+	ev := &auditEvent{
+		Actor:      *newAuditIdentity(admin),
+		Target:     &auditIdentity{UID: uid},
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		b, err := s.loadBan(uid)
+		if err == ErrTokenNotFound {
+			http.Error(w, "User is not banned", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load ban", http.StatusInternalServerError)
+			return
+		}
+		resp, err := json.Marshal(b)
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resp)
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Reason string `json:"reason"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		v, err := json.Marshal(&ban{
+			Reason:   req.Reason,
+			BannedBy: admin.Username,
+			BannedAt: time.Now(),
+		})
+		if err != nil {
+			panic(err)
+		}
+		err = s.stor.Store(banPrefix+uid, string(v), 0)
+		if err == nil {
+			err = s.revokeUser(uid)
+		}
+		if err != nil {
+			log.Println("Failed to ban user:", err)
+			http.Error(w, "Failed to ban user", http.StatusInternalServerError)
+			return
+		}
+
+		ev.Action = "ban"
+		ev.Detail = req.Reason
+		s.audit.Write(ev)
+		w.Write([]byte("{\"status\":\"success\"}\n"))
+	case http.MethodDelete:
+		err := s.stor.Delete(banPrefix + uid)
+		if err != nil {
+			http.Error(w, "Failed to unban user", http.StatusInternalServerError)
+			return
+		}
+
+		ev.Action = "unban"
+		s.audit.Write(ev)
+		w.Write([]byte("{\"status\":\"success\"}\n"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleListBans(w http.ResponseWriter) {
+	keys, err := s.stor.List(banPrefix)
+	if err != nil {
+		http.Error(w, "Failed to list bans", http.StatusInternalServerError)
+		return
+	}
+
+	bans := make(map[string]*ban, len(keys))
+	for _, key := range keys {
+		b, err := s.loadBan(key[len(banPrefix):])
+		if err != nil {
+			continue
+		}
+		bans[key[len(banPrefix):]] = b
+	}
+
+	resp, err := json.Marshal(struct {
+		Bans map[string]*ban `json:"bans"`
+	}{
+		Bans: bans,
+	})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resp)
+}
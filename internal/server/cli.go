@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+)
+
+const cliCodePrefix = "cli:"
+const cliCodeExpiration = 2 * time.Minute
+const cliLoginPrefix = "clip:"
+const cliLoginExpiration = 5 * time.Minute
+
+type cliTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (s *Server) initCLI() {
+	if *s.conf.KubeconfigExecTemplatePath != "" {
+		s.kubeconfigExecTemplate = template.Must(
+			template.ParseFiles(*s.conf.KubeconfigExecTemplatePath),
+		)
+		s.mux.HandleFunc("/_/kubeconfig", s.handleGetExecKubeconfig)
+	}
+
+	s.mux.HandleFunc("/_/cli/confirm", s.handleCLIConfirm)
+	s.mux.HandleFunc("/_/cli/token", s.handleCLIToken)
+}
+
+// externalBaseURL is the scheme and host clients used to reach the proxy
+func externalBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// isLoopbackRedirect only accepts http URLs on the loopback interface, which
+// is where the login command listens for the result of the OAuth flow
+func isLoopbackRedirect(redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "http" || u.User != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// cliLogin is a finished OAuth flow started by the login command, waiting
+// for the user to confirm it
+type cliLogin struct {
+	ImpersonateInfo *ImpersonateInfo `json:"ii"`
+	Redirect        string           `json:"r"`
+	State           string           `json:"s"`
+}
+
+var cliConfirmTemplate = htmltemplate.Must(htmltemplate.New("cli-confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Confirm command line login</title></head>
+<body>
+<h1>Confirm command line login</h1>
+<p>A kube-auth-proxy login command is asking for a token for <b>{{.Username}}</b>.
+It will be sent to the program listening on <b>{{.Host}}</b> on the machine running this browser.</p>
+<p>Only continue if you just ran the login command yourself. On machines shared
+with other users, use <code>login --device</code> instead.</p>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="id" value="{{.ID}}">
+<button type="submit" name="confirm" value="1">Log in</button>
+<button type="submit" name="confirm" value="">Cancel</button>
+</form>
+</body>
+</html>
+`))
+
+// completeCLILogin asks the logged in user to confirm the CLI login before
+// any token is minted. Any page can start the flow with a loopback
+// redirect, and on shared hosts another user may be listening there.
+func (s *Server) completeCLILogin(w http.ResponseWriter, r *http.Request, st *oauthState, ii *ImpersonateInfo) {
+	v, err := json.Marshal(&cliLogin{
+		ImpersonateInfo: ii,
+		Redirect:        st.CLIRedirect,
+		State:           st.CLIState,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	id := utils.GenRandomStateString()
+	err = s.stor.Store(cliLoginPrefix+id, string(v), cliLoginExpiration)
+	if err != nil {
+		log.Println("Failed to store CLI login:", err)
+		http.Error(w, "Failed to store CLI login", http.StatusInternalServerError)
+		return
+	}
+
+	u, _ := url.Parse(st.CLIRedirect) // Validated in handleOAuthRedirect
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; frame-ancestors 'none'")
+	cliConfirmTemplate.Execute(w, struct {
+		Username string
+		Host     string
+		Action   string
+		ID       string
+	}{
+		Username: ii.Username,
+		Host:     u.Host,
+		Action:   path.Join(path.Dir(s.uiBasePath()), "cli", "confirm"),
+		ID:       id,
+	})
+}
+
+// handleCLIConfirm mints the token of a confirmed CLI login and hands a
+// one-time code for it to the login command
+func (s *Server) handleCLIConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v, err := s.stor.LoadAndDelete(cliLoginPrefix + r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid or expired login", http.StatusBadRequest)
+		return
+	}
+	cl := &cliLogin{}
+	err = json.Unmarshal([]byte(v), cl)
+	if err != nil || cl.ImpersonateInfo == nil {
+		http.Error(w, "Invalid or expired login", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("confirm") == "" {
+		w.Write([]byte("Login cancelled, you may close this window.\n"))
+		return
+	}
+
+	ii := cl.ImpersonateInfo
+	rec := &tokenRecord{
+		ImpersonateInfo: ii,
+		Name:            "CLI login",
+		CreatorIP:       clientIP(r),
+	}
+	ttl, _ := s.tokenTTL.Resolve(ii, 0)
+	token, err := s.mintToken(impersonateInfoUID(ii), rec, ttl)
+	if err == ErrTooManyTokens {
+		http.Error(w, "Too many tokens", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to mint CLI token:", err)
+		http.Error(w, "Failed to mint token", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(&cliTokenResponse{
+		Token:     token,
+		ExpiresAt: rec.ExpiresAt,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	code := utils.GenRandomStateString()
+	err = s.stor.Store(cliCodePrefix+code, s.cipher.Encrypt(resp), cliCodeExpiration)
+	if err != nil {
+		log.Println("Failed to store CLI code:", err)
+		http.Error(w, "Failed to store CLI code", http.StatusInternalServerError)
+		return
+	}
+
+	u, _ := url.Parse(cl.Redirect) // Validated in handleOAuthRedirect
+	q := u.Query()
+	q.Set("code", code)
+	q.Set("state", cl.State)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// handleCLIToken exchanges a one-time code for the token minted at login
+func (s *Server) handleCLIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	code := r.FormValue("code")
+	if code == "" {
+		http.Error(w, "No code provided", http.StatusBadRequest)
+		return
+	}
+
+	// Codes are single use, so claim the code before handing out the token
+	v, err := s.stor.LoadAndDelete(cliCodePrefix + code)
+	if err != nil {
+		http.Error(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	resp, err := s.cipher.Decrypt(v)
+	if err != nil {
+		http.Error(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// handleGetExecKubeconfig renders a kubeconfig that obtains credentials
+// through the login command instead of embedding a static token
+func (s *Server) handleGetExecKubeconfig(w http.ResponseWriter, r *http.Request) {
+	ii, _, ok := s.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	vars := struct {
+		Username string
+		ProxyURL string
+	}{
+		Username: ii.Username,
+		ProxyURL: externalBaseURL(r),
+	}
+
+	err := s.kubeconfigExecTemplate.Execute(w, vars)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to render kubeconfig", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+)
+
+const devicePrefix = "dev:"
+const deviceUserCodePrefix = "devu:"
+const deviceCodeExpiration = 10 * time.Minute
+const devicePollInterval = 5 * time.Second
+
+// Consonants only, so user codes cannot spell words and are easy to type
+const deviceUserCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const (
+	deviceStatusPending  = "pending"
+	deviceStatusApproved = "approved"
+	deviceStatusDenied   = "denied"
+)
+
+type deviceAuthorization struct {
+	UserCode  string    `json:"u"`
+	Status    string    `json:"s"`
+	Token     string    `json:"t,omitempty"`
+	TokenExp  time.Time `json:"te,omitempty"`
+	ExpiresAt time.Time `json:"e"`
+	LastPoll  time.Time `json:"p,omitempty"`
+}
+
+func (s *Server) initDevice() {
+	s.mux.HandleFunc("/_/device/code", s.handleDeviceCode)
+	s.mux.HandleFunc("/_/device/approve", s.handleDeviceApprove)
+	s.mux.HandleFunc("/_/device/token", s.handleDeviceToken)
+}
+
+func genDeviceUserCode() string {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	code := make([]byte, 0, 9)
+	for i, b := range buf {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, deviceUserCodeAlphabet[int(b)%len(deviceUserCodeAlphabet)])
+	}
+	return string(code)
+}
+
+// normalizeDeviceUserCode accepts user codes typed in any case, with or
+// without the separator
+func normalizeDeviceUserCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return ""
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func (s *Server) loadDeviceAuthorization(deviceCode string) (*deviceAuthorization, string, error) {
+	v, err := s.stor.Load(devicePrefix + deviceCode)
+	if err != nil {
+		return nil, "", err
+	}
+	da, err := decodeDeviceAuthorization(v)
+	return da, v, err
+}
+
+func decodeDeviceAuthorization(v string) (*deviceAuthorization, error) {
+	da := &deviceAuthorization{}
+	err := json.Unmarshal([]byte(v), da)
+	if err != nil {
+		return nil, err
+	}
+	return da, nil
+}
+
+func (s *Server) storeDeviceAuthorization(deviceCode string, da *deviceAuthorization) error {
+	v, exp := encodeDeviceAuthorization(da)
+	if exp <= 0 {
+		return s.stor.Delete(devicePrefix + deviceCode)
+	}
+	return s.stor.Store(devicePrefix+deviceCode, v, exp)
+}
+
+func encodeDeviceAuthorization(da *deviceAuthorization) (string, time.Duration) {
+	v, err := json.Marshal(da)
+	if err != nil {
+		panic(err)
+	}
+	return string(v), time.Until(da.ExpiresAt)
+}
+
+func writeDeviceError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte("{\"error\":\"" + code + "\"}\n"))
+}
+
+// handleDeviceCode starts a device authorization grant (RFC 8628)
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceCode := utils.GenRandomStateString()
+	da := &deviceAuthorization{
+		UserCode:  genDeviceUserCode(),
+		Status:    deviceStatusPending,
+		ExpiresAt: time.Now().Add(deviceCodeExpiration),
+	}
+
+	err := s.storeDeviceAuthorization(deviceCode, da)
+	if err == nil {
+		err = s.stor.Store(deviceUserCodePrefix+da.UserCode, deviceCode, deviceCodeExpiration)
+	}
+	if err != nil {
+		log.Println("Failed to store device authorization:", err)
+		http.Error(w, "Failed to store device authorization", http.StatusInternalServerError)
+		return
+	}
+
+	verificationURI := externalBaseURL(r) + s.uiBasePath() + "/#/device"
+	resp, err := json.Marshal(struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{
+		DeviceCode:              deviceCode,
+		UserCode:                da.UserCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + da.UserCode,
+		ExpiresIn:               int(deviceCodeExpiration.Seconds()),
+		Interval:                int(devicePollInterval.Seconds()),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// handleDeviceApprove lets a logged in user approve or deny a user code,
+// approving mints a token bound to the approving user
+func (s *Server) handleDeviceApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ii, uid, ok := s.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		UserCode string `json:"user_code"`
+		Deny     bool   `json:"deny"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userCode := normalizeDeviceUserCode(req.UserCode)
+	// Claiming the user code keeps two approvals from both minting a token
+	deviceCode, err := s.stor.LoadAndDelete(deviceUserCodePrefix + userCode)
+	if userCode == "" || err != nil {
+		http.Error(w, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+	da, _, err := s.loadDeviceAuthorization(deviceCode)
+	if err != nil || da.Status != deviceStatusPending {
+		http.Error(w, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+
+	if req.Deny {
+		da.Status = deviceStatusDenied
+	} else {
+		rec := &tokenRecord{
+			ImpersonateInfo: ii,
+			Name:            "Device login " + da.UserCode,
+			CreatorIP:       clientIP(r),
+		}
+		ttl, _ := s.tokenTTL.Resolve(ii, 0)
+		token, err := s.mintToken(uid, rec, ttl)
+		if err == ErrTooManyTokens {
+			http.Error(w, "Too many tokens", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to mint device token:", err)
+			http.Error(w, "Failed to mint token", http.StatusInternalServerError)
+			return
+		}
+		da.Status = deviceStatusApproved
+		// The record lives in storage until the device polls, so keep the
+		// secret out of it in plaintext
+		da.Token = s.cipher.Encrypt([]byte(token))
+		da.TokenExp = rec.ExpiresAt
+	}
+
+	err = s.storeDeviceAuthorization(deviceCode, da)
+	if err != nil {
+		log.Println("Failed to store device authorization:", err)
+		http.Error(w, "Failed to store device authorization", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("{\"status\":\"success\"}\n"))
+}
+
+// handleDeviceToken is polled by the device until the user code is approved
+func (s *Server) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceCode := r.FormValue("device_code")
+	da, v, err := s.loadDeviceAuthorization(deviceCode)
+	if deviceCode == "" || err != nil || time.Now().After(da.ExpiresAt) {
+		writeDeviceError(w, "expired_token")
+		return
+	}
+
+	switch da.Status {
+	case deviceStatusDenied:
+		s.stor.Delete(devicePrefix + deviceCode)
+		writeDeviceError(w, "access_denied")
+		return
+	case deviceStatusPending:
+		tooFast := time.Since(da.LastPoll) < devicePollInterval
+		da.LastPoll = time.Now()
+		// Must not undo an approval saved since the record was loaded
+		newV, exp := encodeDeviceAuthorization(da)
+		if exp > 0 {
+			_, err = s.stor.CompareAndStore(devicePrefix+deviceCode, v, newV, exp)
+			if err != nil {
+				log.Println("Failed to store device authorization:", err)
+			}
+		}
+		if tooFast {
+			writeDeviceError(w, "slow_down")
+		} else {
+			writeDeviceError(w, "authorization_pending")
+		}
+		return
+	}
+
+	// Approved, the token is handed out exactly once
+	v, err = s.stor.LoadAndDelete(devicePrefix + deviceCode)
+	if err == nil {
+		da, err = decodeDeviceAuthorization(v)
+	}
+	if err != nil || da.Status != deviceStatusApproved {
+		writeDeviceError(w, "expired_token")
+		return
+	}
+	token, err := s.cipher.Decrypt(da.Token)
+	if err != nil {
+		// Encrypted with a different secret
+		writeDeviceError(w, "expired_token")
+		return
+	}
+
+	resp, err := json.Marshal(struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{
+		AccessToken: string(token),
+		TokenType:   "Bearer",
+		ExpiresIn:   int(time.Until(da.TokenExp).Seconds()),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+)
+
+const hashedExtraPrefix = "sha256:"
+
+// extrasPolicy decides which OAuth profile fields are forwarded as
+// impersonation extras, and which of them are only forwarded as hashes.
+// Extras that do not come from the profile, e.g. from group rules, are
+// always kept.
+type extrasPolicy struct {
+	allow map[string]bool
+	hash  map[string]bool
+	salt  []byte
+}
+
+func newExtrasPolicy(conf *config.ServerConfig) (*extrasPolicy, error) {
+	p := &extrasPolicy{
+		allow: make(map[string]bool),
+		hash:  make(map[string]bool),
+		salt:  []byte(*conf.ExtrasHashSalt),
+	}
+	for _, f := range strings.Split(*conf.ExtrasAllow, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			p.allow[f] = true
+		}
+	}
+	for _, f := range strings.Split(*conf.ExtrasHash, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			p.hash[f] = true
+		}
+	}
+	// Unsalted hashes of low-entropy fields are trivially reversed
+	if len(p.hash) > 0 && len(p.salt) == 0 {
+		return nil, errors.New("-extras-hash needs -extras-hash-salt")
+	}
+	return p, nil
+}
+
+func (p *extrasPolicy) hashValue(v string) string {
+	if strings.HasPrefix(v, hashedExtraPrefix) {
+		return v // Already hashed
+	}
+	h := hmac.New(sha256.New, p.salt)
+	h.Write([]byte(v))
+	return hashedExtraPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// Apply filters and hashes the extras of ii in place
+func (p *extrasPolicy) Apply(ii *ImpersonateInfo) {
+	for k, vv := range ii.Extra {
+		if !isOAuthUserInfoField(k) {
+			continue
+		}
+		if p.hash[k] {
+			hashed := make([]string, len(vv))
+			for i, v := range vv {
+				hashed[i] = p.hashValue(v)
+			}
+			ii.Extra[k] = hashed
+			continue
+		}
+		if !p.allow[k] {
+			delete(ii.Extra, k)
+		}
+	}
+}
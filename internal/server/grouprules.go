@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+)
+
+type groupRule struct {
+	*config.GroupRule
+	re *regexp.Regexp
+}
+
+func compileGroupRules(rules []*config.GroupRule) ([]*groupRule, error) {
+	compiled := make([]*groupRule, 0, len(rules))
+	for _, r := range rules {
+		if !isOAuthUserInfoField(r.Field) {
+			return nil, fmt.Errorf("unknown user info field in group rule: %s", r.Field)
+		}
+
+		gr := &groupRule{GroupRule: r}
+		switch r.Match {
+		case "", "equals", "contains", "prefix", "suffix", "exists":
+		case "regex":
+			re, err := regexp.Compile(r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex in group rule: %w", err)
+			}
+			gr.re = re
+		default:
+			return nil, fmt.Errorf("unknown group rule match: %s", r.Match)
+		}
+		compiled = append(compiled, gr)
+	}
+	return compiled, nil
+}
+
+func userInfoField(ui *OAuthUserInfo, field string) []string {
+	var v string
+	switch field {
+	case "id":
+		v = ui.ID
+	case "name":
+		v = ui.Name
+	case "email":
+		v = ui.Email
+	case "realname":
+		v = ui.Realname
+	case "telephone":
+		v = ui.Telephone
+	case "school":
+		v = ui.School
+	case "studentGrade":
+		v = ui.StudentGrade
+	case "verified":
+		return ui.Verified
+	}
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+// matches reports whether any value of the field satisfies the rule
+func (r *groupRule) matches(ui *OAuthUserInfo) bool {
+	values := userInfoField(ui, r.Field)
+	if r.Match == "exists" {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		var ok bool
+		switch r.Match {
+		case "", "equals":
+			ok = v == r.Value
+		case "contains":
+			ok = strings.Contains(v, r.Value)
+		case "prefix":
+			ok = strings.HasPrefix(v, r.Value)
+		case "suffix":
+			ok = strings.HasSuffix(v, r.Value)
+		case "regex":
+			ok = r.re.MatchString(v)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGroupRules adds the groups and extras of every matching rule to ii
+func applyGroupRules(rules []*groupRule, ui *OAuthUserInfo, ii *ImpersonateInfo) {
+	for _, r := range rules {
+		if !r.matches(ui) {
+			continue
+		}
+
+		for _, g := range r.Groups {
+			if !slices.Contains(ii.Group, g) {
+				ii.Group = append(ii.Group, g)
+			}
+		}
+		for k, v := range r.Extra {
+			if ii.Extra == nil {
+				ii.Extra = make(map[string][]string)
+			}
+			if !slices.Contains(ii.Extra[k], v) {
+				ii.Extra[k] = append(ii.Extra[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+)
+
+const identityCachePrefix = "idc:"
+
+type identityCacheEntry struct {
+	UserInfo  *OAuthUserInfo `json:"u"`
+	FetchedAt time.Time      `json:"t"`
+}
+
+// IdentityCache caches OAuth user info keyed by a hash of the access token
+type IdentityCache struct {
+	stor   TokenStorage
+	ttl    time.Duration
+	stale  time.Duration
+	flight *utils.Singleflight
+}
+
+func NewIdentityCache(stor TokenStorage, ttl time.Duration, stale time.Duration) *IdentityCache {
+	return &IdentityCache{
+		stor:   stor,
+		ttl:    ttl,
+		stale:  stale,
+		flight: utils.NewSingleflight(),
+	}
+}
+
+func (s *Server) initIdentityCache() error {
+	switch *s.conf.IdentityCache {
+	case "none", "":
+		return nil
+	case "memory":
+		stor, err := NewTokenStorageMemory("")
+		if err != nil {
+			return err
+		}
+		s.idCache = NewIdentityCache(stor, *s.conf.IdentityCacheTTL, *s.conf.IdentityCacheStale)
+	case "storage":
+		s.idCache = NewIdentityCache(s.stor, *s.conf.IdentityCacheTTL, *s.conf.IdentityCacheStale)
+	default:
+		return errors.New("unknown identity cache type")
+	}
+	return nil
+}
+
+func (ic *IdentityCache) load(key string) (*identityCacheEntry, bool) {
+	v, err := ic.stor.Load(identityCachePrefix + key)
+	if err != nil {
+		return nil, false
+	}
+
+	e := &identityCacheEntry{}
+	err = json.Unmarshal([]byte(v), e)
+	if err != nil || e.UserInfo == nil {
+		return nil, false
+	}
+	return e, true
+}
+
+func (ic *IdentityCache) store(key string, ui *OAuthUserInfo) {
+	v, err := json.Marshal(&identityCacheEntry{
+		UserInfo:  ui,
+		FetchedAt: time.Now(),
+	})
+	if err != nil {
+		panic(err) // Should never fail
+	}
+
+	err = ic.stor.Store(identityCachePrefix+key, string(v), ic.ttl+ic.stale)
+	if err != nil {
+		log.Println("Failed to store identity cache entry:", err)
+	}
+}
+
+// Get returns cached user info for the token, calling fetch at most once
+// concurrently per token. Stale entries are served when fetch fails for
+// reasons other than the provider rejecting the token.
+func (ic *IdentityCache) Get(token string, fetch func() (*OAuthUserInfo, error)) (*OAuthUserInfo, error) {
+	key := utils.HashToken(token)
+
+	e, ok := ic.load(key)
+	if ok && time.Since(e.FetchedAt) < ic.ttl {
+		return e.UserInfo, nil
+	}
+
+	v, err := ic.flight.Do(key, func() (interface{}, error) {
+		ui, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		ic.store(key, ui)
+		return ui, nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrOAuthUnauthorized) {
+			ic.stor.Delete(identityCachePrefix + key)
+			return nil, err
+		}
+		if ok && time.Since(e.FetchedAt) < ic.ttl+ic.stale {
+			log.Println("Serving stale identity after provider error:", err)
+			return e.UserInfo, nil
+		}
+		return nil, err
+	}
+
+	return v.(*OAuthUserInfo), nil
+}
@@ -7,10 +7,48 @@ import (
 )
 
 type ImpersonateInfo struct {
-	UID      string            `json:"i"`
-	Username string            `json:"u"`
-	Group    []string          `json:"g"`
-	Extra    map[string]string `json:"e"`
+	UID      string              `json:"i"`
+	Username string              `json:"u"`
+	Group    []string            `json:"g"`
+	Extra    map[string][]string `json:"e"`
+
+	// passthrough requests keep their own credentials instead of being
+	// impersonated
+	passthrough bool
+	// scope restricts requests made with a scoped sk: token
+	scope *tokenScope
+}
+
+func (ii *ImpersonateInfo) UnmarshalJSON(b []byte) error {
+	type plain ImpersonateInfo
+	p := &struct {
+		*plain
+		Extra map[string]json.RawMessage `json:"e"`
+	}{
+		plain: (*plain)(ii),
+	}
+	err := json.Unmarshal(b, p)
+	if err != nil {
+		return err
+	}
+
+	// Older records store single-valued extras
+	ii.Extra = nil
+	for k, raw := range p.Extra {
+		if ii.Extra == nil {
+			ii.Extra = make(map[string][]string, len(p.Extra))
+		}
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return err
+			}
+			values = []string{v}
+		}
+		ii.Extra[k] = values
+	}
+	return nil
 }
 
 func ImpersonateInfoFromString(s string) (*ImpersonateInfo, error) {
@@ -40,9 +78,63 @@ func (ii *ImpersonateInfo) Clean(req *http.Request) {
 
 func (ii *ImpersonateInfo) Render(req *http.Request) {
 	req.Header.Set("Impersonate-User", ii.Username)
-	req.Header.Set("Impersonate-Group", ii.Group[0])
-	req.Header.Set("Impersonate-Uid", ii.UID)
-	for k, v := range ii.Extra {
-		req.Header.Set("Impersonate-Extra-"+k, v)
+	for _, g := range ii.Group {
+		req.Header.Add("Impersonate-Group", g)
+	}
+	if ii.UID != "" {
+		req.Header.Set("Impersonate-Uid", ii.UID)
+	}
+	for k, vv := range ii.Extra {
+		key := "Impersonate-Extra-" + escapeExtraKey(k)
+		for _, v := range vv {
+			req.Header.Add(key, escapeExtraValue(v))
+		}
+	}
+}
+
+const upperHex = "0123456789ABCDEF"
+
+func isHeaderTokenByte(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&'*+-.^_`|~", b) >= 0
+}
+
+// escapeExtraKey lowercases the key and percent-encodes every byte that is
+// not a legal header token character, as the apiserver unescapes extra
+// keys with url.PathUnescape
+func escapeExtraKey(key string) string {
+	key = strings.ToLower(key)
+	buf := strings.Builder{}
+	for i := 0; i < len(key); i++ {
+		b := key[i]
+		if isHeaderTokenByte(b) {
+			buf.WriteByte(b)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(upperHex[b>>4])
+		buf.WriteByte(upperHex[b&15])
+	}
+	return buf.String()
+}
+
+// escapeExtraValue percent-encodes control characters, which cannot appear
+// in header values at all; the apiserver takes values verbatim, so every
+// other byte is left untouched
+func escapeExtraValue(v string) string {
+	buf := strings.Builder{}
+	for i := 0; i < len(v); i++ {
+		b := v[i]
+		if b < 0x20 && b != '\t' || b == 0x7f {
+			buf.WriteByte('%')
+			buf.WriteByte(upperHex[b>>4])
+			buf.WriteByte(upperHex[b&15])
+			continue
+		}
+		buf.WriteByte(b)
 	}
+	return buf.String()
 }
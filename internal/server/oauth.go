@@ -1,49 +1,231 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"path"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
 	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
 	"golang.org/x/oauth2"
 )
 
-func (s *Server) oauthInit() {
-	s.mux.HandleFunc("/_/oauth/callback", s.handleOAuthCallback)
-	s.mux.HandleFunc("/_/oauth/redirect", s.handleOAuthRedirect)
+// loginProvider is a configured OAuth provider users can log in with
+type loginProvider struct {
+	Name     string
+	Conf     *config.OAuthProviderConfig
+	Provider OAuthProvider
+	Rules    []*groupRule
+}
+
+func (s *Server) oauthInit() error {
+	confs, err := s.conf.LoadOAuthProviders()
+	if err != nil {
+		return err
+	}
+	globalRules, err := s.conf.LoadGroupRules()
+	if err != nil {
+		return err
+	}
+
+	s.providers = make(map[string]*loginProvider)
+	for _, conf := range confs {
+		provider, err := NewOAuthProvider(conf)
+		if err != nil {
+			return fmt.Errorf("oauth provider %s: %w", conf.Name, err)
+		}
+		rules, err := compileGroupRules(append(slices.Clone(globalRules), conf.GroupRules...))
+		if err != nil {
+			return fmt.Errorf("oauth provider %s: %w", conf.Name, err)
+		}
+
+		p := &loginProvider{
+			Name:     conf.Name,
+			Conf:     conf,
+			Provider: provider,
+			Rules:    rules,
+		}
+		s.providers[p.Name] = p
+		if s.defaultProvider == nil {
+			s.defaultProvider = p
+		}
+
+		s.mux.HandleFunc("/_/oauth/"+p.Name+"/redirect", func(w http.ResponseWriter, r *http.Request) {
+			s.handleOAuthRedirect(w, r, p)
+		})
+		s.mux.HandleFunc("/_/oauth/"+p.Name+"/callback", func(w http.ResponseWriter, r *http.Request) {
+			s.handleOAuthCallback(w, r, p)
+		})
+	}
+
+	if s.defaultProvider == nil {
+		log.Println("No OAuth providers configured, OAuth login is disabled")
+		return nil
+	}
+
+	s.mux.HandleFunc("/_/oauth/callback", func(w http.ResponseWriter, r *http.Request) {
+		s.handleOAuthCallback(w, r, s.defaultProvider)
+	})
+	s.mux.HandleFunc("/_/oauth/redirect", func(w http.ResponseWriter, r *http.Request) {
+		s.handleOAuthRedirect(w, r, s.defaultProvider)
+	})
+	s.mux.HandleFunc("/_/oauth/providers", s.handleListOAuthProviders)
 	s.mux.HandleFunc("/_/oauth/userinfo", s.handleGetOAuthUserInfo)
 
-	s.oauthConfig = &oauth2.Config{
-		Endpoint: oauth2.Endpoint{
-			AuthURL:   "https://hpcgame.pku.edu.cn/oauth/authorize",
-			TokenURL:  "https://hpcgame.pku.edu.cn/api/oauth/access_token",
-			AuthStyle: oauth2.AuthStyleInParams,
-		},
-		ClientID:     *s.conf.OAuthAppID,
-		ClientSecret: *s.conf.OAuthSecret,
-		RedirectURL:  *s.conf.OAuthCallback,
+	return nil
+}
+
+// resolveOAuthToken splits a "<provider>:<token>" bearer token, tokens
+// without a known provider prefix belong to the default provider
+func (s *Server) resolveOAuthToken(token string) (*loginProvider, string) {
+	if name, rest, ok := strings.Cut(token, ":"); ok {
+		if p, ok := s.providers[name]; ok {
+			return p, rest
+		}
 	}
+	return s.defaultProvider, token
 }
 
-func (s *Server) handleOAuthRedirect(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleListOAuthProviders(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp, err := json.Marshal(struct {
+		Default   string   `json:"default"`
+		Providers []string `json:"providers"`
+	}{
+		Default:   s.defaultProvider.Name,
+		Providers: names,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	w.Write(resp)
+}
+
+const oauthStateCookie = "kube_auth_proxy_oauth_state"
+const oauthStateExpiration = 10 * time.Minute
+
+type oauthState struct {
+	Provider string `json:"p"`
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	ReturnTo string `json:"r,omitempty"`
+
+	// Set when the login command started the flow
+	CLIRedirect string `json:"cr,omitempty"`
+	CLIState    string `json:"cs,omitempty"`
+}
+
+// isSafeReturnTo only allows local UI routes, so return_to cannot be used
+// as an open redirect
+func isSafeReturnTo(returnTo string) bool {
+	return strings.HasPrefix(returnTo, "/") &&
+		!strings.HasPrefix(returnTo, "//") &&
+		!strings.ContainsAny(returnTo, "\\\r\n")
+}
+
+// secureCookies reports whether the proxy is served over https, judging
+// by where the providers send users back to
+func (s *Server) secureCookies() bool {
+	for _, p := range s.providers {
+		if strings.HasPrefix(p.Conf.Callback, "https://") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleOAuthRedirect(w http.ResponseWriter, r *http.Request, p *loginProvider) {
+	st := &oauthState{
+		Provider: p.Name,
+		State:    utils.GenRandomStateString(),
+		Verifier: oauth2.GenerateVerifier(),
+	}
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		if !isSafeReturnTo(returnTo) {
+			http.Error(w, "Invalid return_to", http.StatusBadRequest)
+			return
+		}
+		st.ReturnTo = returnTo
+	}
+	if cliRedirect := r.URL.Query().Get("cli_redirect"); cliRedirect != "" {
+		if !isLoopbackRedirect(cliRedirect) {
+			http.Error(w, "Invalid cli_redirect", http.StatusBadRequest)
+			return
+		}
+		st.CLIRedirect = cliRedirect
+		st.CLIState = r.URL.Query().Get("cli_state")
+	}
+
+	cookie, err := s.signer.Sign(st, oauthStateExpiration)
+	if err != nil {
+		log.Println("Failed to sign OAuth state:", err)
+		http.Error(w, "Failed to sign OAuth state", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    cookie,
+		Path:     "/",
+		MaxAge:   int(oauthStateExpiration.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
 	// Redirect to the OAuth provider
-	http.Redirect(w, r, s.oauthConfig.AuthCodeURL(
-		utils.GenRandomStateString(),
+	http.Redirect(w, r, p.Provider.OAuthConfig().AuthCodeURL(
+		st.State,
+		oauth2.S256ChallengeOption(st.Verifier),
 	), http.StatusTemporaryRedirect)
 }
 
-func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
-	// TODO: FIXME: Check state string
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request, p *loginProvider) {
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		http.Error(w, "Missing OAuth state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	st := &oauthState{}
+	err = s.signer.Verify(cookie.Value, st)
+	if err != nil || st.Provider != p.Name {
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+	state := r.FormValue("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(st.State)) != 1 {
+		http.Error(w, "OAuth state mismatch", http.StatusBadRequest)
+		return
+	}
 
 	// Handle the OAuth callback
 	code := r.FormValue("code")
-	token, err := s.oauthConfig.Exchange(r.Context(), code)
+	ctx, cancel := providerContext(r.Context())
+	defer cancel()
+	token, err := p.Provider.OAuthConfig().Exchange(ctx, code, oauth2.VerifierOption(st.Verifier))
 	if err != nil {
 		log.Println("Failed to exchange token:", err)
 		http.Redirect(w, r, "redirect", http.StatusTemporaryRedirect)
@@ -52,13 +234,13 @@ func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// TODO: Write reconcile User object logic
-	userInfo, err := s.getOAuthUserInfo(token.AccessToken)
+	userInfo, err := s.getOAuthUserInfo(p, token.AccessToken)
 	if err != nil {
 		log.Println("Failed to get user info:", err)
 		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
 		return
 	}
-	ii := s.userInfoToImpersonateInfo(userInfo)
+	ii := s.userInfoToImpersonateInfo(p, userInfo)
 	err = s.reconcileUser(ii)
 	if err != nil {
 		log.Println("Failed to reconcile user:", err)
@@ -66,57 +248,85 @@ func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if st.CLIRedirect != "" {
+		s.completeCLILogin(w, r, st, ii)
+		return
+	}
+
+	err = s.createSession(w, p, ii, token)
+	if err != nil {
+		log.Println("Failed to create session:", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
 	// Redirect to the UI
-	u, err := url.Parse(*s.conf.OAuthCallback)
+	base, err := uiBasePath(p.Conf.Callback)
 	if err != nil {
 		log.Println("Failed to parse OAuth callback URL:", err)
 		http.Error(w, "Failed to parse OAuth callback URL", http.StatusInternalServerError)
 		return
 	}
-	base := filepath.Join(filepath.Dir(filepath.Dir(u.RequestURI())), "/ui/#/auth/token")
-	http.Redirect(w, r, fmt.Sprintf("%s/%s", base, token.AccessToken), http.StatusTemporaryRedirect)
-	w.Write([]byte(fmt.Sprintf("{\"token\":\"%s\"}", token.AccessToken)))
-}
-
-func (s *Server) getOAuthUserInfo(token string) (*OAuthUserInfo, error) {
-	if strings.HasPrefix(token, "Bearer ") {
-		token = token[7:]
+	returnTo := "/"
+	if st.ReturnTo != "" {
+		returnTo = st.ReturnTo
 	}
+	http.Redirect(w, r, base+"/#"+returnTo, http.StatusTemporaryRedirect)
+}
 
-	uid, err := utils.ExtractUIDFromJWT(token)
+// uiBasePath derives the UI path from a callback URL such as
+// https://example.com/_/oauth/<provider>/callback
+func uiBasePath(callback string) (string, error) {
+	u, err := url.Parse(callback)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	p := u.Path
+	if i := strings.LastIndex(p, "/oauth/"); i >= 0 {
+		p = p[:i]
 	}
+	return path.Join("/", p, "ui"), nil
+}
 
-	userInfoURL := fmt.Sprintf("https://hpcgame.pku.edu.cn/api/user/%s/profile", uid)
-	req, err := http.NewRequest("GET", userInfoURL, nil)
-	if err != nil {
-		return nil, err
+// uiBasePath returns the path the UI is served under
+func (s *Server) uiBasePath() string {
+	if s.defaultProvider != nil {
+		if base, err := uiBasePath(s.defaultProvider.Conf.Callback); err == nil {
+			return base
+		}
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	return "/_/ui"
+}
+
+func (s *Server) getOAuthUserInfo(p *loginProvider, token string) (*OAuthUserInfo, error) {
+	if strings.HasPrefix(token, "Bearer ") {
+		token = token[7:]
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	err := p.Provider.Verify(token)
 	if err != nil {
 		return nil, err
 	}
 
-	if strings.Contains(string(body), "\"error\":\"Unauthorized\"") {
-		return nil, fmt.Errorf("Unauthorized")
+	fetch := func() (*OAuthUserInfo, error) {
+		ctx, cancel := providerContext(context.Background())
+		defer cancel()
+		return p.Provider.UserInfo(ctx, token)
+	}
+	var ui *OAuthUserInfo
+	if s.idCache == nil {
+		ui, err = fetch()
+	} else {
+		ui, err = s.idCache.Get(p.Name+":"+token, fetch)
 	}
-
-	rslt := &OAuthUserInfo{}
-	err = json.Unmarshal(body, rslt)
 	if err != nil {
 		return nil, err
 	}
-	rslt.ID = uid
-
-	return rslt, nil
+	// ":" separates the prefix in usernames and the UID in sk: tokens
+	if ui.ID == "" || strings.Contains(ui.ID, ":") {
+		return nil, fmt.Errorf("invalid user id %q from provider %s", ui.ID, p.Name)
+	}
+	return ui, nil
 }
 
 type OAuthUserInfo struct {
@@ -130,14 +340,22 @@ type OAuthUserInfo struct {
 	Verified     []string `json:"verified"`
 }
 
+func isOAuthUserInfoField(field string) bool {
+	switch field {
+	case "id", "name", "email", "realname", "telephone", "school", "studentGrade", "verified":
+		return true
+	}
+	return false
+}
+
 func (s *Server) handleGetOAuthUserInfo(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if token == "" {
-		http.Error(w, "No token provided", http.StatusUnauthorized)
+		writeUnauthorized(w, ErrAuthenticationRequired)
 		return
 	}
 
-	userInfo, err := s.getOAuthUserInfo(token)
+	userInfo, err := s.getOAuthUserInfo(s.resolveOAuthToken(token))
 	if err != nil {
 		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
 		return
@@ -152,20 +370,29 @@ func (s *Server) handleGetOAuthUserInfo(w http.ResponseWriter, r *http.Request)
 	w.Write(resp)
 }
 
-func (s *Server) userInfoToImpersonateInfo(userInfo *OAuthUserInfo) *ImpersonateInfo {
+func (s *Server) userInfoToImpersonateInfo(p *loginProvider, userInfo *OAuthUserInfo) *ImpersonateInfo {
+	uid, username := userInfo.ID, userInfo.ID
+	if p.Conf.Prefix != "" {
+		// UIDs name User objects, so they must stay valid DNS subdomains.
+		// Prefixes never contain "-", so the first one ends the prefix.
+		uid = p.Conf.Prefix + "-" + userInfo.ID
+		username = p.Conf.Prefix + ":" + userInfo.ID
+	}
+
 	ii := &ImpersonateInfo{
-		UID: userInfo.ID,
-		// TODO: More elegant way to handle ID
-		Username: userInfo.ID,
-		Group:    []string{*s.conf.OAuthDefaultGroup},
-		Extra: map[string]string{
-			"name":         userInfo.Name,
-			"email":        userInfo.Email,
-			"realname":     userInfo.Realname,
-			"telephone":    userInfo.Telephone,
-			"school":       userInfo.School,
-			"studentGrade": userInfo.StudentGrade,
+		UID:      uid,
+		Username: username,
+		Group:    []string{p.Conf.DefaultGroup},
+		Extra: map[string][]string{
+			"name":         {userInfo.Name},
+			"email":        {userInfo.Email},
+			"realname":     {userInfo.Realname},
+			"telephone":    {userInfo.Telephone},
+			"school":       {userInfo.School},
+			"studentGrade": {userInfo.StudentGrade},
 		},
 	}
+	s.extras.Apply(ii)
+	applyGroupRules(p.Rules, userInfo, ii)
 	return ii
 }
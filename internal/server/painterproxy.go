@@ -14,7 +14,14 @@ func (s *Server) initPainterProxy() {
 	painterRev := httputil.NewSingleHostReverseProxy(urlURL)
 
 	painterHandler := func(w http.ResponseWriter, r *http.Request) {
+		// Subject to the anonymous policy like the other /_/ endpoints
+		_, err := s.authenticate(r)
+		if err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/_/painter")
+		stripSessionCookies(r)
 		painterRev.ServeHTTP(w, r)
 	}
 	s.mux.HandleFunc("/_/painter", painterHandler)
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+	"golang.org/x/oauth2"
+)
+
+type OAuthProvider interface {
+	OAuthConfig() *oauth2.Config
+	// Verify checks the token locally without contacting the provider
+	Verify(token string) error
+	UserInfo(ctx context.Context, token string) (*OAuthUserInfo, error)
+}
+
+// providerTimeout bounds every call to an OAuth provider, so that a hung
+// provider fails like an unreachable one
+const providerTimeout = 10 * time.Second
+
+var providerHTTPClient = &http.Client{Timeout: providerTimeout}
+
+// providerContext returns a context for provider calls that also makes
+// oauth2 token requests use providerHTTPClient
+func providerContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, providerTimeout)
+	return context.WithValue(ctx, oauth2.HTTPClient, providerHTTPClient), cancel
+}
+
+// ErrOAuthUnauthorized is returned when the provider rejects a token
+var ErrOAuthUnauthorized = errors.New("Unauthorized")
+
+// ErrOAuthUnavailable wraps provider-side failures such as 5xx responses
+var ErrOAuthUnavailable = errors.New("oauth provider unavailable")
+
+// isProviderUnavailable reports whether err means the provider could not
+// answer, as opposed to it or local verification rejecting the token
+func isProviderUnavailable(err error) bool {
+	var ne net.Error
+	re := &oauth2.RetrieveError{}
+	return errors.Is(err, ErrOAuthUnavailable) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &ne) ||
+		(errors.As(err, &re) && re.Response != nil && re.Response.StatusCode >= 500)
+}
+
+var oauthProviders = make(map[string](func(*config.OAuthProviderConfig) (OAuthProvider, error)))
+
+func RegisterOAuthProvider(name string, f func(*config.OAuthProviderConfig) (OAuthProvider, error)) {
+	oauthProviders[name] = f
+}
+
+func NewOAuthProvider(conf *config.OAuthProviderConfig) (OAuthProvider, error) {
+	if f, ok := oauthProviders[conf.Type]; ok {
+		return f(conf)
+	}
+
+	return nil, errors.New("unknown oauth provider type")
+}
+
+// newJWTVerifier returns nil when no JWKS URL is known, which disables local verification
+func newJWTVerifier(conf *config.OAuthProviderConfig, jwksURL string, issuer string) *utils.JWTVerifier {
+	if conf.JWKSURL != "" {
+		jwksURL = conf.JWKSURL
+	}
+	if conf.TokenIssuer != "" {
+		issuer = conf.TokenIssuer
+	}
+	if jwksURL == "" {
+		return nil
+	}
+
+	return utils.NewJWTVerifier(
+		utils.NewJWKS(jwksURL, conf.JWKSRefresh),
+		issuer,
+		conf.Audience,
+	)
+}
+
+// parseClaimMapping parses a claim mapping like "id=sub,name=preferred_username"
+func parseClaimMapping(s string) (map[string]string, error) {
+	claims := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		field, claim, ok := strings.Cut(pair, "=")
+		if !ok || field == "" || claim == "" {
+			return nil, fmt.Errorf("invalid claim mapping: %s", pair)
+		}
+		if !isOAuthUserInfoField(field) {
+			return nil, fmt.Errorf("unknown user info field: %s", field)
+		}
+		claims[field] = claim
+	}
+	return claims, nil
+}
+
+func claimsToUserInfo(claims map[string]interface{}, mapping map[string]string) *OAuthUserInfo {
+	rslt := &OAuthUserInfo{}
+	for field, claim := range mapping {
+		v := lookupClaim(claims, claim)
+		switch field {
+		case "id":
+			rslt.ID = claimString(v)
+		case "name":
+			rslt.Name = claimString(v)
+		case "email":
+			rslt.Email = claimString(v)
+		case "realname":
+			rslt.Realname = claimString(v)
+		case "telephone":
+			rslt.Telephone = claimString(v)
+		case "school":
+			rslt.School = claimString(v)
+		case "studentGrade":
+			rslt.StudentGrade = claimString(v)
+		case "verified":
+			rslt.Verified = claimStrings(v)
+		}
+	}
+	return rslt
+}
+
+// lookupClaim resolves a dotted claim path such as "address.country"
+func lookupClaim(claims map[string]interface{}, path string) interface{} {
+	var cur interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	return cur
+}
+
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		rslt := make([]string, 0, len(v))
+		for _, e := range v {
+			rslt = append(rslt, claimString(e))
+		}
+		return rslt
+	default:
+		return []string{claimString(v)}
+	}
+}
+
+func init() {
+	RegisterOAuthProvider("hpcgame", NewOAuthProviderHPCGame)
+	RegisterOAuthProvider("oidc", NewOAuthProviderOIDC)
+}
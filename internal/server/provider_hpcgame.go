@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+	"golang.org/x/oauth2"
+)
+
+const hpcgameDefaultClaims = "name=name,email=email,realname=realname,telephone=telephone,school=school,studentGrade=studentGrade,verified=verified"
+
+type OAuthProviderHPCGame struct {
+	oauthConfig *oauth2.Config
+	verifier    *utils.JWTVerifier
+
+	// claims maps OAuthUserInfo JSON field names to profile fields
+	claims map[string]string
+}
+
+func NewOAuthProviderHPCGame(conf *config.OAuthProviderConfig) (OAuthProvider, error) {
+	claimsStr := conf.Claims
+	if claimsStr == "" {
+		claimsStr = hpcgameDefaultClaims
+	}
+	claims, err := parseClaimMapping(claimsStr)
+	if err != nil {
+		return nil, err
+	}
+	delete(claims, "id") // The ID always comes from the token
+
+	verifier := newJWTVerifier(conf, "", "")
+	if verifier == nil {
+		if conf.VerifyJWT == nil || *conf.VerifyJWT {
+			return nil, fmt.Errorf("oauth provider %s needs a JWKS URL unless JWT verification is disabled", conf.Name)
+		}
+		log.Printf("Warning: JWT verification disabled, %s tokens are trusted without checking their signature", conf.Name)
+	}
+
+	return &OAuthProviderHPCGame{
+		oauthConfig: &oauth2.Config{
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://hpcgame.pku.edu.cn/oauth/authorize",
+				TokenURL:  "https://hpcgame.pku.edu.cn/api/oauth/access_token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			ClientID:     conf.ClientID,
+			ClientSecret: conf.ClientSecret,
+			RedirectURL:  conf.Callback,
+		},
+		verifier: verifier,
+		claims:   claims,
+	}, nil
+}
+
+func (p *OAuthProviderHPCGame) OAuthConfig() *oauth2.Config {
+	return p.oauthConfig
+}
+
+func (p *OAuthProviderHPCGame) Verify(token string) error {
+	_, err := p.extractUID(token)
+	return err
+}
+
+func (p *OAuthProviderHPCGame) UserInfo(ctx context.Context, token string) (*OAuthUserInfo, error) {
+	uid, err := p.extractUID(token)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfoURL := fmt.Sprintf("https://hpcgame.pku.edu.cn/api/user/%s/profile", uid)
+	req, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(string(body), "\"error\":\"Unauthorized\"") {
+		return nil, ErrOAuthUnauthorized
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("%w: profile request failed: %s", ErrOAuthUnavailable, resp.Status)
+	}
+
+	profile := make(map[string]interface{})
+	err = json.Unmarshal(body, &profile)
+	if err != nil {
+		return nil, err
+	}
+	rslt := claimsToUserInfo(profile, p.claims)
+	rslt.ID = uid
+
+	return rslt, nil
+}
+
+func (p *OAuthProviderHPCGame) extractUID(token string) (string, error) {
+	if p.verifier == nil {
+		return utils.ExtractUIDFromJWT(token)
+	}
+
+	claims, err := p.verifier.Verify(token)
+	if err != nil {
+		return "", err
+	}
+
+	uid, ok := claims["userId"].(string)
+	if !ok {
+		return "", fmt.Errorf("userId field not found or is not a string")
+	}
+	return uid, nil
+}
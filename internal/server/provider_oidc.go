@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+	"golang.org/x/oauth2"
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type OAuthProviderOIDC struct {
+	oauthConfig *oauth2.Config
+	discovery   *oidcDiscovery
+	verifier    *utils.JWTVerifier
+
+	// claims maps OAuthUserInfo JSON field names to OIDC claim names
+	claims map[string]string
+}
+
+const oidcDefaultClaims = "id=sub,name=preferred_username,email=email,realname=name"
+
+func NewOAuthProviderOIDC(conf *config.OAuthProviderConfig) (OAuthProvider, error) {
+	issuer := strings.TrimSuffix(conf.Issuer, "/")
+	if issuer == "" {
+		return nil, errors.New("oidc issuer is required")
+	}
+
+	discovery, err := discoverOIDC(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsStr := conf.Claims
+	if claimsStr == "" {
+		claimsStr = oidcDefaultClaims
+	}
+	claims, err := parseClaimMapping(claimsStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims["id"] == "" {
+		claims["id"] = "sub"
+	}
+
+	var verifier *utils.JWTVerifier
+	if conf.VerifyJWT == nil || *conf.VerifyJWT {
+		verifier = newJWTVerifier(conf, discovery.JWKSURI, discovery.Issuer)
+	}
+
+	return &OAuthProviderOIDC{
+		oauthConfig: &oauth2.Config{
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  discovery.AuthorizationEndpoint,
+				TokenURL: discovery.TokenEndpoint,
+			},
+			ClientID:     conf.ClientID,
+			ClientSecret: conf.ClientSecret,
+			RedirectURL:  conf.Callback,
+			Scopes:       conf.Scopes,
+		},
+		discovery: discovery,
+		verifier:  verifier,
+		claims:    claims,
+	}, nil
+}
+
+func discoverOIDC(issuer string) (*oidcDiscovery, error) {
+	resp, err := providerHTTPClient.Get(issuer + oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery failed: %s", resp.Status)
+	}
+
+	d := &oidcDiscovery{}
+	err = json.NewDecoder(resp.Body).Decode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch: expected %s, got %s", issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" {
+		return nil, errors.New("oidc discovery document is missing required endpoints")
+	}
+
+	return d, nil
+}
+
+func (p *OAuthProviderOIDC) OAuthConfig() *oauth2.Config {
+	return p.oauthConfig
+}
+
+func (p *OAuthProviderOIDC) Verify(token string) error {
+	if p.verifier == nil {
+		return nil
+	}
+	_, err := p.verifier.Verify(token)
+	return err
+}
+
+func (p *OAuthProviderOIDC) UserInfo(ctx context.Context, token string) (*OAuthUserInfo, error) {
+	err := p.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, ErrOAuthUnauthorized
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("%w: userinfo request failed: %s", ErrOAuthUnavailable, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo request failed: %s", resp.Status)
+	}
+
+	claims := make(map[string]interface{})
+	err = json.Unmarshal(body, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claimsToUserInfo(claims, p.claims), nil
+}
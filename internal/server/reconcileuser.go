@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"maps"
+	"slices"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
@@ -81,6 +84,29 @@ func (s *Server) kubeCreateUser(u *useroperatorv1alpha1.User) (*useroperatorv1al
 	return ur, nil
 }
 
+func (s *Server) kubeUpdateUser(u *useroperatorv1alpha1.User) (*useroperatorv1alpha1.User, error) {
+	u.SetGroupVersionKind(s.userGVK)
+	unstruct, err := runtime.DefaultUnstructuredConverter.ToUnstructured(u)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := s.kubeClient.Resource(s.userGVR).Update(context.TODO(), &unstructured.Unstructured{
+		Object: unstruct,
+	}, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	ur := &useroperatorv1alpha1.User{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, ur)
+	if err != nil {
+		return nil, err
+	}
+
+	return ur, nil
+}
+
 func (s *Server) reconcileUser(ii *ImpersonateInfo) error {
 	u := &useroperatorv1alpha1.User{
 		ObjectMeta: metav1.ObjectMeta{
@@ -90,13 +116,13 @@ func (s *Server) reconcileUser(ii *ImpersonateInfo) error {
 			Username: ii.Username,
 			UID:      ii.UID,
 			Groups:   ii.Group,
-			Extra:    ii.Extra,
+			Extra:    flattenExtra(ii.Extra),
 		},
 	}
 
 	u.SetGroupVersionKind(s.userGVK)
 
-	_, err := s.kubeGetUser(ii.UID)
+	existing, err := s.kubeGetUser(ii.UID)
 
 	if err != nil {
 		if client.IgnoreNotFound(err) == nil {
@@ -107,5 +133,70 @@ func (s *Server) reconcileUser(ii *ImpersonateInfo) error {
 		return err
 	}
 
+	// Keep groups and extras of existing users in line with the current
+	// group rules and extras policy
+	if !slices.Equal(existing.Spec.Groups, u.Spec.Groups) || !maps.Equal(existing.Spec.Extra, u.Spec.Extra) {
+		existing.Spec.Groups = u.Spec.Groups
+		existing.Spec.Extra = u.Spec.Extra
+		_, err = s.kubeUpdateUser(existing)
+		if err != nil {
+			return err
+		}
+		log.Println("Updated user groups and extras", ii.UID)
+	}
+
 	return nil
 }
+
+var extraEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`)
+
+// flattenExtra joins multi-valued extras, as the User spec holds one value
+// per key; "," and "\" in values are escaped so splitExtra can undo it
+func flattenExtra(extra map[string][]string) map[string]string {
+	if extra == nil {
+		return nil
+	}
+	rslt := make(map[string]string, len(extra))
+	for k, vv := range extra {
+		escaped := make([]string, len(vv))
+		for i, v := range vv {
+			escaped[i] = extraEscaper.Replace(v)
+		}
+		rslt[k] = strings.Join(escaped, ",")
+	}
+	return rslt
+}
+
+// splitExtra reverses flattenExtra for a single key
+func splitExtra(s string) []string {
+	vv := []string{}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case s[i] == ',':
+			vv = append(vv, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return append(vv, b.String())
+}
+
+func userToImpersonateInfo(u *useroperatorv1alpha1.User) *ImpersonateInfo {
+	ii := &ImpersonateInfo{
+		UID:      u.Spec.UID,
+		Username: u.Spec.Username,
+		Group:    append([]string{}, u.Spec.Groups...),
+	}
+	for k, v := range u.Spec.Extra {
+		if ii.Extra == nil {
+			ii.Extra = make(map[string][]string, len(u.Spec.Extra))
+		}
+		ii.Extra[k] = splitExtra(v)
+	}
+	return ii
+}
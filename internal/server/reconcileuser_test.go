@@ -0,0 +1,25 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFlattenExtraRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{""},
+		{"alice"},
+		{"a", "b"},
+		{"a,b"},
+		{"a,b", "c"},
+		{`back\slash`, `trailing\`},
+		{`\,`, ",", ""},
+	}
+
+	for _, vv := range tests {
+		flat := flattenExtra(map[string][]string{"k": vv})["k"]
+		if got := splitExtra(flat); !slices.Equal(got, vv) {
+			t.Errorf("splitExtra(%q) = %q, want %q", flat, got, vv)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequestInfo describes a Kubernetes API request the way the apiserver's
+// RequestInfoFactory does, for the subset of paths served through the proxy
+type RequestInfo struct {
+	IsResourceRequest bool
+	Path              string
+	Verb              string
+
+	APIPrefix   string
+	APIGroup    string
+	APIVersion  string
+	Namespace   string
+	Resource    string
+	Subresource string
+	Name        string
+}
+
+var namespaceSubresources = map[string]bool{"status": true, "finalize": true}
+
+// parseRequestInfo follows k8s.io/apiserver/pkg/endpoints/request:
+//
+//	/api/{version}/namespaces/{namespace}/{resource}/{name}/{subresource}
+//	/apis/{group}/{version}/watch/{resource}
+//
+// and anything else is a non-resource request
+func parseRequestInfo(req *http.Request) *RequestInfo {
+	ri := &RequestInfo{
+		Path: req.URL.Path,
+		Verb: strings.ToLower(req.Method),
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 2 || (parts[0] != "api" && parts[0] != "apis") {
+		return ri
+	}
+	ri.APIPrefix = parts[0]
+	parts = parts[1:]
+
+	if ri.APIPrefix == "apis" {
+		if len(parts) < 2 {
+			return ri // API group discovery
+		}
+		ri.APIGroup = parts[0]
+		parts = parts[1:]
+	}
+	ri.APIVersion = parts[0]
+	parts = parts[1:]
+	if len(parts) == 0 {
+		return ri // API version discovery
+	}
+
+	ri.IsResourceRequest = true
+	switch req.Method {
+	case http.MethodPost:
+		ri.Verb = "create"
+	case http.MethodGet, http.MethodHead:
+		ri.Verb = "get"
+	case http.MethodPut:
+		ri.Verb = "update"
+	case http.MethodPatch:
+		ri.Verb = "patch"
+	case http.MethodDelete:
+		ri.Verb = "delete"
+	default:
+		ri.Verb = ""
+	}
+
+	if parts[0] == "watch" {
+		if ri.Verb == "get" {
+			ri.Verb = "watch"
+		}
+		parts = parts[1:]
+		if len(parts) == 0 {
+			ri.IsResourceRequest = false
+			return ri
+		}
+	}
+
+	if parts[0] == "namespaces" {
+		if len(parts) > 1 {
+			ri.Namespace = parts[1]
+			if len(parts) > 2 && !namespaceSubresources[parts[2]] {
+				parts = parts[2:]
+			}
+		}
+	}
+
+	ri.Resource = parts[0]
+	if len(parts) > 1 {
+		ri.Name = parts[1]
+	}
+	if len(parts) > 2 {
+		ri.Subresource = parts[2]
+	}
+
+	if ri.Name == "" {
+		switch ri.Verb {
+		case "get":
+			ri.Verb = "list"
+		case "delete":
+			ri.Verb = "deletecollection"
+		}
+	}
+	if ri.Verb == "list" || ri.Verb == "get" {
+		// The apiserver accepts any boolean spelling, e.g. watch=1
+		if watch, _ := strconv.ParseBool(req.URL.Query().Get("watch")); watch {
+			ri.Verb = "watch"
+		}
+	}
+
+	return ri
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRequestInfo(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   RequestInfo
+	}{
+		{"GET", "/api", RequestInfo{Verb: "get"}},
+		{"GET", "/apis/apps", RequestInfo{Verb: "get", APIPrefix: "apis"}},
+		{"GET", "/api/v1", RequestInfo{Verb: "get", APIPrefix: "api", APIVersion: "v1"}},
+		{"GET", "/healthz", RequestInfo{Verb: "get"}},
+		{"GET", "/api/v1/pods", RequestInfo{
+			IsResourceRequest: true, Verb: "list", APIPrefix: "api", APIVersion: "v1",
+			Resource: "pods",
+		}},
+		{"GET", "/api/v1/namespaces/default/pods/web", RequestInfo{
+			IsResourceRequest: true, Verb: "get", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods", Name: "web",
+		}},
+		{"GET", "/api/v1/namespaces/default/pods/web/log", RequestInfo{
+			IsResourceRequest: true, Verb: "get", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods", Name: "web", Subresource: "log",
+		}},
+		{"GET", "/api/v1/namespaces/default/pods/web/exec?command=sh", RequestInfo{
+			IsResourceRequest: true, Verb: "get", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods", Name: "web", Subresource: "exec",
+		}},
+		{"POST", "/apis/apps/v1/namespaces/default/deployments", RequestInfo{
+			IsResourceRequest: true, Verb: "create", APIPrefix: "apis", APIGroup: "apps", APIVersion: "v1",
+			Namespace: "default", Resource: "deployments",
+		}},
+		{"DELETE", "/api/v1/namespaces/default/pods", RequestInfo{
+			IsResourceRequest: true, Verb: "deletecollection", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods",
+		}},
+		{"GET", "/api/v1/namespaces/default", RequestInfo{
+			IsResourceRequest: true, Verb: "get", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "namespaces", Name: "default",
+		}},
+		{"PUT", "/api/v1/namespaces/default/finalize", RequestInfo{
+			IsResourceRequest: true, Verb: "update", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "namespaces", Name: "default", Subresource: "finalize",
+		}},
+		{"GET", "/api/v1/namespaces/default/pods?watch=true", RequestInfo{
+			IsResourceRequest: true, Verb: "watch", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods",
+		}},
+		{"GET", "/api/v1/namespaces/default/pods?watch=1", RequestInfo{
+			IsResourceRequest: true, Verb: "watch", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods",
+		}},
+		{"GET", "/api/v1/namespaces/default/pods?watch=false", RequestInfo{
+			IsResourceRequest: true, Verb: "list", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods",
+		}},
+		{"GET", "/api/v1/watch/namespaces/default/pods", RequestInfo{
+			IsResourceRequest: true, Verb: "watch", APIPrefix: "api", APIVersion: "v1",
+			Namespace: "default", Resource: "pods",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			tt.want.Path = req.URL.Path
+			got := parseRequestInfo(req)
+			if *got != tt.want {
+				t.Fatalf("parseRequestInfo() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
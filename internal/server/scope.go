@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var readOnlyVerbs = []string{"get", "list", "watch"}
+
+var knownVerbs = []string{
+	"get", "list", "watch", "create", "update", "patch", "delete", "deletecollection",
+}
+
+var ErrScopedToken = errors.New("scoped tokens may only access the Kubernetes API")
+
+// tokenScope restricts what an sk: token may do. Empty lists do not
+// restrict; resources are "resource", "resource/subresource" or
+// "resource.group", with "*" matching everything.
+type tokenScope struct {
+	ReadOnly   bool     `json:"readOnly,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+	Resources  []string `json:"resources,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+func (sc *tokenScope) Validate() error {
+	for _, v := range sc.Verbs {
+		if v != "*" && !slices.Contains(knownVerbs, v) {
+			return fmt.Errorf("unknown verb %q", v)
+		}
+	}
+	return nil
+}
+
+// IsEmpty reports whether the scope restricts nothing
+func (sc *tokenScope) IsEmpty() bool {
+	return !sc.ReadOnly && len(sc.Verbs) == 0 && len(sc.Resources) == 0 && len(sc.Namespaces) == 0
+}
+
+func (sc *tokenScope) allowsVerb(verb string) bool {
+	if sc.ReadOnly && !slices.Contains(readOnlyVerbs, verb) {
+		return false
+	}
+	return len(sc.Verbs) == 0 || slices.Contains(sc.Verbs, "*") || slices.Contains(sc.Verbs, verb)
+}
+
+func (sc *tokenScope) allowsResource(ri *RequestInfo) bool {
+	if len(sc.Resources) == 0 {
+		return true
+	}
+	resource := ri.Resource
+	if ri.APIGroup != "" {
+		resource += "." + ri.APIGroup
+	}
+	for _, r := range sc.Resources {
+		switch r {
+		case "*":
+			return true
+		case ri.Resource, resource:
+			if ri.Subresource == "" {
+				return true
+			}
+		case ri.Resource + "/" + ri.Subresource, resource + "/" + ri.Subresource, ri.Resource + "/*":
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *tokenScope) allowsNamespace(ri *RequestInfo) bool {
+	if len(sc.Namespaces) == 0 {
+		return true
+	}
+	// Cluster-scoped requests fall outside any namespace list
+	return ri.Namespace != "" && slices.Contains(sc.Namespaces, ri.Namespace)
+}
+
+// Allows checks a request against the scope; non-resource requests such
+// as discovery are only subject to the verbs
+func (sc *tokenScope) Allows(ri *RequestInfo) bool {
+	if !ri.IsResourceRequest {
+		verb := ri.Verb
+		if verb == "head" {
+			verb = "get"
+		}
+		return sc.allowsVerb(verb)
+	}
+	verb := ri.Verb
+	if connectSubresources[ri.Subresource] {
+		// exec, attach and friends arrive as GET over WebSocket, but they
+		// are not reads
+		verb = "create"
+	}
+	return sc.allowsVerb(verb) && sc.allowsResource(ri) && sc.allowsNamespace(ri)
+}
+
+var connectSubresources = map[string]bool{
+	"exec":        true,
+	"attach":      true,
+	"portforward": true,
+	"proxy":       true,
+}
+
+// writeScopeForbidden responds like the apiserver does to a request RBAC
+// denies, so clients report it the same way
+func writeScopeForbidden(w http.ResponseWriter, ii *ImpersonateInfo, ri *RequestInfo) {
+	var msg string
+	details := &metav1.StatusDetails{}
+	if ri.IsResourceRequest {
+		resource := ri.Resource
+		if ri.Subresource != "" {
+			resource += "/" + ri.Subresource
+		}
+		msg = fmt.Sprintf("User %q cannot %s resource %q in API group %q", ii.Username, ri.Verb, resource, ri.APIGroup)
+		if ri.Namespace != "" {
+			msg += fmt.Sprintf(" in the namespace %q", ri.Namespace)
+		}
+		if ri.Name != "" {
+			msg = fmt.Sprintf("%s %q is forbidden: %s", resource, ri.Name, msg)
+		} else {
+			msg = fmt.Sprintf("%s is forbidden: %s", resource, msg)
+		}
+		details.Name = ri.Name
+		details.Group = ri.APIGroup
+		details.Kind = ri.Resource
+	} else {
+		msg = fmt.Sprintf("forbidden: User %q cannot %s path %q", ii.Username, ri.Verb, ri.Path)
+	}
+	msg += ": outside the scope of the token"
+
+	b, err := json.Marshal(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  msg,
+		Reason:   metav1.StatusReasonForbidden,
+		Details:  details,
+		Code:     http.StatusForbidden,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(b)
+}
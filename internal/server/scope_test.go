@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenScopeAllows(t *testing.T) {
+	readOnly := &tokenScope{ReadOnly: true}
+	getList := &tokenScope{Verbs: []string{"get", "list"}}
+	allResources := &tokenScope{Resources: []string{"*"}}
+	pods := &tokenScope{Resources: []string{"pods"}}
+	podLogs := &tokenScope{Resources: []string{"pods/log"}}
+	deployments := &tokenScope{Resources: []string{"deployments.apps"}}
+	creator := &tokenScope{Verbs: []string{"create"}}
+	defaultNS := &tokenScope{Namespaces: []string{"default"}}
+
+	tests := []struct {
+		name   string
+		scope  *tokenScope
+		method string
+		url    string
+		want   bool
+	}{
+		{"read-only get", readOnly, "GET", "/api/v1/namespaces/default/pods/web", true},
+		{"read-only watch", readOnly, "GET", "/api/v1/pods?watch=1", true},
+		{"read-only create", readOnly, "POST", "/api/v1/namespaces/default/pods", false},
+		{"read-only discovery", readOnly, "GET", "/apis", true},
+		{"read-only exec", readOnly, "GET", "/api/v1/namespaces/default/pods/web/exec", false},
+		{"read-only attach", readOnly, "POST", "/api/v1/namespaces/default/pods/web/attach", false},
+		{"read-only portforward", readOnly, "GET", "/api/v1/namespaces/default/pods/web/portforward", false},
+		{"read-only service proxy", readOnly, "GET", "/api/v1/namespaces/default/services/web/proxy", false},
+		{"read-only log", readOnly, "GET", "/api/v1/namespaces/default/pods/web/log", true},
+
+		{"get/list list", getList, "GET", "/api/v1/pods", true},
+		{"get/list watch", getList, "GET", "/api/v1/pods?watch=true", false},
+		{"get/list watch=1", getList, "GET", "/api/v1/pods?watch=1", false},
+		{"get/list watch path", getList, "GET", "/api/v1/watch/pods", false},
+		{"get/list exec", getList, "GET", "/api/v1/namespaces/default/pods/web/exec", false},
+		{"create exec", creator, "GET", "/api/v1/namespaces/default/pods/web/exec", true},
+
+		{"* pods", allResources, "GET", "/api/v1/pods", true},
+		{"* pods/log", allResources, "GET", "/api/v1/namespaces/default/pods/web/log", true},
+		{"* pods/status", allResources, "PATCH", "/api/v1/namespaces/default/pods/web/status", true},
+		{"pods pods", pods, "GET", "/api/v1/namespaces/default/pods/web", true},
+		{"pods pods/log", pods, "GET", "/api/v1/namespaces/default/pods/web/log", false},
+		{"pods services", pods, "GET", "/api/v1/services", false},
+		{"pods/log pods/log", podLogs, "GET", "/api/v1/namespaces/default/pods/web/log", true},
+		{"pods/log pods", podLogs, "GET", "/api/v1/namespaces/default/pods/web", false},
+		{"deployments.apps", deployments, "GET", "/apis/apps/v1/namespaces/default/deployments", true},
+		{"deployments.apps other group", deployments, "GET", "/apis/extensions/v1beta1/namespaces/default/deployments", false},
+
+		{"namespace match", defaultNS, "GET", "/api/v1/namespaces/default/pods", true},
+		{"namespace other", defaultNS, "GET", "/api/v1/namespaces/kube-system/pods", false},
+		{"namespace cluster-scoped", defaultNS, "GET", "/api/v1/nodes", false},
+		{"namespace all namespaces", defaultNS, "GET", "/api/v1/pods", false},
+		{"namespace object itself", defaultNS, "GET", "/api/v1/namespaces/default", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ri := parseRequestInfo(httptest.NewRequest(tt.method, tt.url, nil))
+			if got := tt.scope.Allows(ri); got != tt.want {
+				t.Fatalf("Allows(%s %s) = %v, want %v (%+v)", tt.method, tt.url, got, tt.want, *ri)
+			}
+		})
+	}
+}
@@ -2,17 +2,20 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"text/template"
 	"time"
 
 	"github.com/lcpu-club/kube-auth-proxy/internal/config"
 	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
-	"golang.org/x/oauth2"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
@@ -24,12 +27,23 @@ type Server struct {
 	upstream *url.URL
 	rev      *httputil.ReverseProxy
 
-	sm   *utils.SecretManager
-	stor TokenStorage
+	sm        *utils.SecretManager
+	stor      TokenStorage
+	signer    *utils.Signer
+	cipher    *utils.Cipher
+	tokenFile *StaticTokenFile
 
-	oauthConfig *oauth2.Config
+	providers       map[string]*loginProvider
+	defaultProvider *loginProvider
+	idCache         *IdentityCache
+	extras          *extrasPolicy
+	anonymous       *anonymousPolicy
+	audit           *auditLog
+	tokenTTL        *tokenTTLPolicy
+	sessionFlight   *utils.Singleflight
 
-	kubeconfigTemplate *template.Template
+	kubeconfigTemplate     *template.Template
+	kubeconfigExecTemplate *template.Template
 
 	kubeClient *dynamic.DynamicClient
 	scheme     *runtime.Scheme
@@ -42,6 +56,8 @@ func NewServer(conf *config.ServerConfig) *Server {
 		mux:  http.NewServeMux(),
 		conf: conf,
 		sm:   utils.NewSecretManager(*conf.KubeSecretPath),
+
+		sessionFlight: utils.NewSingleflight(),
 	}
 }
 
@@ -51,6 +67,53 @@ func (s *Server) Init() (err error) {
 		return err
 	}
 
+	if *s.conf.CookieSecret != "" {
+		s.signer = utils.NewSigner([]byte(*s.conf.CookieSecret))
+		s.cipher = utils.NewCipher([]byte(*s.conf.CookieSecret))
+	} else {
+		log.Println("Warning: no cookie secret configured, using an ephemeral key")
+		s.signer = utils.NewRandomSigner()
+		s.cipher = utils.NewRandomCipher()
+	}
+
+	s.extras, err = newExtrasPolicy(s.conf)
+	if err != nil {
+		return err
+	}
+
+	s.anonymous, err = newAnonymousPolicy(s.conf)
+	if err != nil {
+		return err
+	}
+
+	s.audit, err = newAuditLog(*s.conf.AuditLog)
+	if err != nil {
+		return err
+	}
+
+	s.tokenTTL, err = newTokenTTLPolicy(s.conf)
+	if err != nil {
+		return err
+	}
+
+	switch *s.conf.ServiceAccountTokens {
+	case serviceAccountTokensOff, serviceAccountTokensPassthrough, serviceAccountTokensImpersonate:
+	default:
+		return fmt.Errorf("unknown service account token mode %q", *s.conf.ServiceAccountTokens)
+	}
+
+	if *s.conf.TokenAuthFile != "" {
+		s.tokenFile, err = NewStaticTokenFile(*s.conf.TokenAuthFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.initIdentityCache()
+	if err != nil {
+		return err
+	}
+
 	s.upstream, err = url.Parse(*s.conf.Upstream)
 	if err != nil {
 		return err
@@ -78,9 +141,26 @@ func (s *Server) Init() (err error) {
 		},
 	}
 
-	s.oauthInit()
-	s.initToken()
+	err = s.oauthInit()
+	if err != nil {
+		return err
+	}
+	s.initSession()
+	s.initBan()
+	s.initAdmin()
+	err = s.initToken()
+	if err != nil {
+		return err
+	}
+	s.initCLI()
+	s.initDevice()
 	s.initPainterProxy()
+	if *s.conf.TokenReview {
+		err = s.initTokenReview()
+		if err != nil {
+			return err
+		}
+	}
 	s.mux.Handle("/_/whoami", http.HandlerFunc(s.handleWhoAmI))
 
 	s.mux.Handle("/_/ui/", http.StripPrefix("/_/ui/", http.FileServer(http.Dir(*s.conf.UIDistPath))))
@@ -92,11 +172,29 @@ func (s *Server) Init() (err error) {
 func (s *Server) HandleProxy(w http.ResponseWriter, r *http.Request) {
 	ii, err := s.authenticate(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeUnauthorized(w, err)
+		return
+	}
+
+	if ii.scope != nil {
+		if ri := parseRequestInfo(r); !ii.scope.Allows(ri) {
+			writeScopeForbidden(w, ii, ri)
+			return
+		}
+	}
+
+	ii, err = s.actAs(r, ii)
+	if err != nil {
+		writeActAsError(w, err)
 		return
 	}
 
 	ii.Clean(r)
+	stripSessionCookies(r)
+	if ii.passthrough {
+		s.rev.ServeHTTP(w, r)
+		return
+	}
 	ii.Render(r)
 
 	r.Header.Set("Authorization", "Bearer "+s.sm.GetToken())
@@ -106,7 +204,31 @@ func (s *Server) HandleProxy(w http.ResponseWriter, r *http.Request) {
 func (s *Server) Start() error {
 	log.Println("Listening on", *s.conf.Listen)
 	if *s.conf.TLSCertFile != "" && *s.conf.TLSKeyFile != "" {
-		return http.ListenAndServeTLS(*s.conf.Listen, *s.conf.TLSCertFile, *s.conf.TLSKeyFile, s.mux)
+		srv := &http.Server{
+			Addr:    *s.conf.Listen,
+			Handler: s.mux,
+		}
+
+		if *s.conf.TLSClientCAFile != "" {
+			caBytes, err := os.ReadFile(*s.conf.TLSClientCAFile)
+			if err != nil {
+				return err
+			}
+			clientCAs := x509.NewCertPool()
+			if !clientCAs.AppendCertsFromPEM(caBytes) {
+				return errors.New("no certificates found in client CA file")
+			}
+
+			srv.TLSConfig = &tls.Config{
+				ClientCAs:  clientCAs,
+				ClientAuth: tls.VerifyClientCertIfGiven,
+			}
+		}
+
+		return srv.ListenAndServeTLS(*s.conf.TLSCertFile, *s.conf.TLSKeyFile)
+	}
+	if *s.conf.TLSClientCAFile != "" {
+		log.Println("Warning: client CA file is ignored without TLS")
 	}
 	return http.ListenAndServe(*s.conf.Listen, s.mux)
 }
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+	useroperatorv1alpha1 "github.com/lcpu-club/user-operator/api/v1alpha1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const serviceAccountCachePrefix = "sac:"
+
+const (
+	serviceAccountTokensOff         = "off"
+	serviceAccountTokensPassthrough = "passthrough"
+	serviceAccountTokensImpersonate = "impersonate"
+)
+
+var ErrServiceAccountTokenInvalid = errors.New("invalid service account token")
+
+type serviceAccountCacheEntry struct {
+	ImpersonateInfo *ImpersonateInfo `json:"ii"`
+	Passthrough     bool             `json:"p"`
+}
+
+// isServiceAccountToken recognizes legacy and projected ServiceAccount
+// tokens by their claims, without verifying them
+func isServiceAccountToken(token string) bool {
+	claims, err := utils.ExtractClaimsFromJWT(token)
+	if err != nil {
+		return false
+	}
+	if iss, _ := claims["iss"].(string); iss == "kubernetes/serviceaccount" {
+		return true
+	}
+	_, ok := claims["kubernetes.io"]
+	return ok
+}
+
+func (s *Server) reviewToken(token string) (*authenticationv1.TokenReview, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&authenticationv1.TokenReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: authenticationv1.SchemeGroupVersion.String(),
+			Kind:       "TokenReview",
+		},
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.kubeClient.Resource(authenticationv1.SchemeGroupVersion.WithResource("tokenreviews")).
+		Create(context.TODO(), &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	review := &authenticationv1.TokenReview{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(res.Object, review)
+	if err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+// findNamespaceOwner finds the User whose u-<uid> namespace this is
+func (s *Server) findNamespaceOwner(namespace string) (*useroperatorv1alpha1.User, error) {
+	uid, ok := strings.CutPrefix(namespace, "u-")
+	if !ok || uid == "" {
+		return nil, nil
+	}
+
+	// User objects are named after the UID
+	u, err := s.kubeGetUser(uid)
+	if err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return u, nil
+}
+
+func (s *Server) resolveServiceAccountToken(token string) (*serviceAccountCacheEntry, error) {
+	review, err := s.reviewToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, ErrServiceAccountTokenInvalid
+	}
+
+	user := review.Status.User
+	e := &serviceAccountCacheEntry{
+		ImpersonateInfo: &ImpersonateInfo{
+			UID:      user.UID,
+			Username: user.Username,
+			Group:    user.Groups,
+		},
+		Passthrough: true,
+	}
+
+	// system:serviceaccount:<namespace>:<name>
+	parts := strings.Split(user.Username, ":")
+	if *s.conf.ServiceAccountTokens != serviceAccountTokensImpersonate ||
+		len(parts) != 4 || !strings.HasPrefix(parts[2], "u-") {
+		return e, nil
+	}
+
+	owner, err := s.findNamespaceOwner(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if owner == nil {
+		return e, nil
+	}
+	return &serviceAccountCacheEntry{ImpersonateInfo: userToImpersonateInfo(owner)}, nil
+}
+
+// authenticateServiceAccount validates a ServiceAccount token against the
+// upstream. Depending on configuration the token is either passed through
+// or replaced by the identity of the user owning its namespace.
+func (s *Server) authenticateServiceAccount(token string) (*ImpersonateInfo, error) {
+	key := serviceAccountCachePrefix + utils.HashToken(token)
+
+	e := &serviceAccountCacheEntry{}
+	v, err := s.stor.Load(key)
+	if err == nil && json.Unmarshal([]byte(v), e) == nil && e.ImpersonateInfo != nil {
+		e.ImpersonateInfo.passthrough = e.Passthrough
+		return e.ImpersonateInfo, nil
+	}
+
+	e, err = s.resolveServiceAccountToken(token)
+	if err != nil {
+		if err != ErrServiceAccountTokenInvalid {
+			log.Println("Failed to review service account token:", err)
+		}
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if ttl := *s.conf.IdentityCacheTTL; ttl > 0 {
+		b, err := json.Marshal(e)
+		if err != nil {
+			panic(err)
+		}
+		err = s.stor.Store(key, string(b), min(ttl, time.Hour))
+		if err != nil {
+			log.Println("Failed to cache service account token:", err)
+		}
+	}
+
+	e.ImpersonateInfo.passthrough = e.Passthrough
+	return e.ImpersonateInfo, nil
+}
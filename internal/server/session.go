@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+	"golang.org/x/oauth2"
+)
+
+const sessionPrefix = "ses:"
+const sessionCookie = "kube_auth_proxy_session"
+const csrfCookie = "kube_auth_proxy_csrf"
+const csrfHeader = "X-CSRF-Token"
+
+var ErrCSRFTokenMismatch = errors.New("CSRF token mismatch")
+var ErrCrossOriginWebSocket = errors.New("cross-origin WebSocket")
+var ErrSessionRevoked = errors.New("session revoked")
+
+// Sessions holding a refresh token last until logout or revocation; this
+// is only the longest lifetime browsers accept for a cookie
+const sessionRefreshMaxAge = 400 * 24 * time.Hour
+
+// session is a browser login; the cookie only carries the secret naming the
+// record, the identity and the provider token never leave the server
+type session struct {
+	ImpersonateInfo *ImpersonateInfo `json:"ii"`
+	Provider        string           `json:"p"`
+	CSRF            string           `json:"c"`
+	ExpiresAt       time.Time        `json:"e"`
+
+	// Encrypted oauth2.Token, only kept when it has a refresh token
+	Token string `json:"t,omitempty"`
+	// When the provider last confirmed the identity
+	VerifiedAt time.Time `json:"v,omitempty"`
+
+	// The stored value this session was read from
+	raw string
+}
+
+func (s *Server) initSession() {
+	s.mux.HandleFunc("/_/session/logout", s.handleLogout)
+}
+
+func (s *Server) createSession(w http.ResponseWriter, p *loginProvider, ii *ImpersonateInfo, token *oauth2.Token) error {
+	uid := ii.UID
+	if uid == "" {
+		uid = ii.Username
+	}
+
+	id := uid + ":" + utils.GenerateRandomString(*s.conf.TokenLength, "")
+	ses := &session{
+		ImpersonateInfo: ii,
+		Provider:        p.Name,
+		CSRF:            utils.GenRandomStateString(),
+		ExpiresAt:       time.Now().Add(*s.conf.SessionExpiration),
+		VerifiedAt:      time.Now(),
+	}
+	if token.RefreshToken != "" {
+		ses.Token = s.encryptOAuthToken(token)
+		ses.ExpiresAt = time.Now().Add(sessionRefreshMaxAge)
+	}
+	err := s.storeSession(id, ses)
+	if err != nil {
+		return err
+	}
+
+	maxAge := int(time.Until(ses.ExpiresAt).Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Readable by the UI, which echoes it in the CSRF header
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    ses.CSRF,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// sessionKey stores a session under a hash of its cookie value, keeping the
+// uid so that revokeUser finds it, like tokenKey does for sk: tokens
+func sessionKey(id string) string {
+	i := strings.LastIndex(id, ":")
+	return sessionPrefix + id[:i+1] + utils.HashToken(id)
+}
+
+// migrateSession moves a session stored under its plaintext cookie value
+func (s *Server) migrateSession(id string) (string, error) {
+	v, err := s.stor.LoadAndDelete(sessionPrefix + id)
+	if err != nil {
+		return "", err
+	}
+	ses := &session{}
+	err = json.Unmarshal([]byte(v), ses)
+	if err != nil {
+		return "", err
+	}
+	exp := time.Until(ses.ExpiresAt)
+	if exp <= 0 {
+		return "", ErrTokenNotFound
+	}
+	return v, s.stor.Store(sessionKey(id), v, exp)
+}
+
+func (s *Server) storeSession(id string, ses *session) error {
+	v, err := json.Marshal(ses)
+	if err != nil {
+		panic(err)
+	}
+	return s.stor.Store(sessionKey(id), string(v), time.Until(ses.ExpiresAt))
+}
+
+func (s *Server) loadSession(id string) (*session, error) {
+	v, err := s.stor.Load(sessionKey(id))
+	if err == ErrTokenNotFound {
+		v, err = s.migrateSession(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ses := &session{}
+	err = json.Unmarshal([]byte(v), ses)
+	if err != nil {
+		return nil, err
+	}
+	if ses.ImpersonateInfo == nil || time.Now().After(ses.ExpiresAt) {
+		return nil, ErrTokenNotFound
+	}
+	ses.raw = v
+	return ses, nil
+}
+
+// updateSession stores ses unless the session changed or was deleted
+// since it was loaded
+func (s *Server) updateSession(id string, ses *session) error {
+	v, err := json.Marshal(ses)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.stor.CompareAndStore(sessionKey(id), ses.raw, string(v), time.Until(ses.ExpiresAt))
+	return err
+}
+
+func (s *Server) encryptOAuthToken(token *oauth2.Token) string {
+	b, err := json.Marshal(token)
+	if err != nil {
+		panic(err)
+	}
+	return s.cipher.Encrypt(b)
+}
+
+func (s *Server) decryptOAuthToken(str string) (*oauth2.Token, error) {
+	b, err := s.cipher.Decrypt(str)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	err = json.Unmarshal(b, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// isRefreshRevoked reports whether the provider refused the refresh token,
+// as opposed to being unreachable
+func isRefreshRevoked(err error) bool {
+	re := &oauth2.RetrieveError{}
+	if !errors.As(err, &re) {
+		return false
+	}
+	if re.ErrorCode != "" {
+		return re.ErrorCode == "invalid_grant"
+	}
+	return re.Response != nil && re.Response.StatusCode >= 400 && re.Response.StatusCode < 500
+}
+
+// sessionImpersonateInfo re-resolves the identity of a session holding a
+// provider token, refreshing the access token once it expires or is
+// rejected. While the provider is unreachable the stored identity is used
+// for as long as a cached identity would be.
+func (s *Server) sessionImpersonateInfo(id string, ses *session) (*ImpersonateInfo, error) {
+	p := s.providers[ses.Provider]
+	if p == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	token, err := s.decryptOAuthToken(ses.Token)
+	if err != nil {
+		// Encrypted with a different secret
+		s.stor.Delete(sessionKey(id))
+		return nil, err
+	}
+
+	if token.Valid() {
+		ui, err := s.getOAuthUserInfo(p, token.AccessToken)
+		if err == nil {
+			ii := s.userInfoToImpersonateInfo(p, ui)
+			if time.Since(ses.VerifiedAt) > *s.conf.IdentityCacheTTL {
+				ses.ImpersonateInfo = ii
+				ses.VerifiedAt = time.Now()
+				err = s.updateSession(id, ses)
+				if err != nil {
+					log.Println("Failed to store session:", err)
+				}
+			}
+			return ii, nil
+		}
+		if isProviderUnavailable(err) {
+			return s.staleSessionIdentity(ses, err)
+		}
+		// Rejected by the provider or by local verification, e.g. an
+		// expired JWT from a provider that sent no expires_in
+	}
+
+	ii, err := s.sessionFlight.Do(id, func() (interface{}, error) {
+		// A request that finished just before, or another replica, may
+		// already have used the refresh token
+		cur, err := s.loadSession(id)
+		if err != nil {
+			return nil, err
+		}
+		if cur.Token != ses.Token {
+			return cur.ImpersonateInfo, nil
+		}
+		return s.refreshSession(p, id, cur, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ii.(*ImpersonateInfo), nil
+}
+
+// staleSessionIdentity serves the stored identity while the provider is
+// failing, within the identity cache's stale window
+func (s *Server) staleSessionIdentity(ses *session, err error) (*ImpersonateInfo, error) {
+	if time.Since(ses.VerifiedAt) > *s.conf.IdentityCacheTTL+*s.conf.IdentityCacheStale {
+		return nil, err
+	}
+	log.Println("Provider unavailable, using stored session identity:", err)
+	return ses.ImpersonateInfo, nil
+}
+
+func (s *Server) refreshSession(p *loginProvider, id string, ses *session, token *oauth2.Token) (*ImpersonateInfo, error) {
+	// Clearing the access token makes the token source refresh even if
+	// the provider rejected a token that has not expired yet
+	token.AccessToken = ""
+	ctx, cancel := providerContext(context.Background())
+	defer cancel()
+	newToken, err := p.Provider.OAuthConfig().TokenSource(ctx, token).Token()
+	if err != nil {
+		if isRefreshRevoked(err) {
+			s.stor.Delete(sessionKey(id))
+			return nil, ErrSessionRevoked
+		}
+		if isProviderUnavailable(err) {
+			return s.staleSessionIdentity(ses, err)
+		}
+		return nil, err
+	}
+
+	// Keep the new token even if the identity cannot be fetched, the old
+	// refresh token may have been rotated away
+	ses.Token = s.encryptOAuthToken(newToken)
+	ui, err := s.getOAuthUserInfo(p, newToken.AccessToken)
+	if err == nil {
+		ses.ImpersonateInfo = s.userInfoToImpersonateInfo(p, ui)
+		ses.VerifiedAt = time.Now()
+	}
+	storeErr := s.updateSession(id, ses)
+	if storeErr != nil {
+		log.Println("Failed to store refreshed session:", storeErr)
+	}
+	if err != nil {
+		if isProviderUnavailable(err) {
+			return s.staleSessionIdentity(ses, err)
+		}
+		return nil, err
+	}
+	return ses.ImpersonateInfo, nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// isSameOrigin reports whether the Origin header names this host; browsers
+// do not apply CORS to WebSocket handshakes, so cookies need this check
+func isSameOrigin(req *http.Request) bool {
+	u, err := url.Parse(req.Header.Get("Origin"))
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+func hasCSRFToken(req *http.Request, ses *session) bool {
+	csrf := req.Header.Get(csrfHeader)
+	return csrf != "" && subtle.ConstantTimeCompare([]byte(csrf), []byte(ses.CSRF)) == 1
+}
+
+// authenticateSession resolves the session cookie, rejecting state-changing
+// requests without a matching CSRF header
+func (s *Server) authenticateSession(req *http.Request, cookie *http.Cookie) (*ImpersonateInfo, error) {
+	ses, err := s.loadSession(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(req.Header.Get("Upgrade")) == "websocket" {
+		if !isSameOrigin(req) {
+			return nil, ErrCrossOriginWebSocket
+		}
+	} else if !isSafeMethod(req.Method) && !hasCSRFToken(req, ses) {
+		return nil, ErrCSRFTokenMismatch
+	}
+
+	if ses.Token != "" {
+		return s.sessionImpersonateInfo(cookie.Value, ses)
+	}
+
+	s.extras.Apply(ses.ImpersonateInfo)
+	return ses.ImpersonateInfo, nil
+}
+
+// stripSessionCookies keeps the proxy's own cookies from reaching upstream
+func stripSessionCookies(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == sessionCookie || c.Name == csrfCookie {
+			continue
+		}
+		req.AddCookie(c)
+	}
+}
+
+func (s *Server) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == sessionCookie,
+			Secure:   s.secureCookies(),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		// Logging out is state-changing, so it needs the CSRF header too
+		ses, err := s.loadSession(cookie.Value)
+		if err == nil && !hasCSRFToken(r, ses) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		err = s.stor.Delete(sessionKey(cookie.Value))
+		if err != nil && err != ErrTokenNotFound {
+			log.Println("Failed to delete session:", err)
+		}
+	}
+	s.clearSessionCookies(w)
+
+	w.Write([]byte("{\"status\":\"success\"}\n"))
+}
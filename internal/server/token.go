@@ -2,85 +2,419 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
 )
 
+// Last-used times are only written back this often per token
+const tokenLastUsedInterval = time.Minute
+
+const tokenNameMaxLength = 128
+
+const (
+	tokenPageDefault = 50
+	tokenPageMax     = 500
+)
+
+// tokenRecord is what is stored for each sk: token
+type tokenRecord struct {
+	ImpersonateInfo *ImpersonateInfo `json:"ii"`
+	Name            string           `json:"n,omitempty"`
+	CreatedAt       time.Time        `json:"c"`
+	ExpiresAt       time.Time        `json:"x"`
+	LastUsedAt      time.Time        `json:"l,omitempty"`
+	CreatorIP       string           `json:"ip,omitempty"`
+	Scope           *tokenScope      `json:"s,omitempty"`
+	// Hint is the masked token, as the token itself is not stored
+	Hint string `json:"h,omitempty"`
+	// ReplacedBy is the ID of the token this one was rotated to
+	ReplacedBy string `json:"rb,omitempty"`
+
+	// Set for records read in the older bare ImpersonateInfo format
+	legacy bool
+	// The stored value this record was read from
+	raw string
+}
+
+// tokenInfo is the listing of a token, which never contains the secret
+type tokenInfo struct {
+	ID         string      `json:"id"`
+	Token      string      `json:"token"`
+	Name       string      `json:"name"`
+	CreatedAt  *time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time  `json:"lastUsedAt"`
+	CreatorIP  string      `json:"creatorIP"`
+	Scope      *tokenScope `json:"scope"`
+	ReplacedBy string      `json:"replacedBy,omitempty"`
+}
+
+// Tokens are handed out as sk:<uid>:<random> but stored under
+// skh:<uid>:<sha256 of the token>, the hash doubling as the token ID
+const tokenPrefix = "sk:"
+const tokenKeyPrefix = "skh:"
+
 func (s *Server) generateToken(uid string) string {
-	return utils.GenerateRandomString(*s.conf.TokenLength, "sk:"+uid+":")
+	return utils.GenerateRandomString(*s.conf.TokenLength, tokenPrefix+uid+":")
+}
+
+// tokenKey is the storage key of a token
+func tokenKey(token string) string {
+	i := strings.LastIndex(token, ":") + 1
+	return tokenKeyPrefix + token[len(tokenPrefix):i] + utils.HashToken(token)
+}
+
+// tokenID identifies a token in the API without revealing it
+func tokenID(key string) string {
+	return key[strings.LastIndex(key, ":")+1:]
+}
+
+// maskToken keeps the prefix and a few characters of the secret, enough
+// to tell tokens apart
+func maskToken(token string) string {
+	i := strings.LastIndex(token, ":") + 1
+	secret := token[i:]
+	if len(secret) <= 8 {
+		return token[:i] + "****"
+	}
+	return token[:i] + secret[:4] + "****" + secret[len(secret)-4:]
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (rec *tokenRecord) info(key string) *tokenInfo {
+	return &tokenInfo{
+		ID:         tokenID(key),
+		Token:      rec.Hint,
+		Name:       rec.Name,
+		CreatedAt:  optionalTime(rec.CreatedAt),
+		ExpiresAt:  optionalTime(rec.ExpiresAt),
+		LastUsedAt: optionalTime(rec.LastUsedAt),
+		CreatorIP:  rec.CreatorIP,
+		Scope:      rec.Scope,
+		ReplacedBy: rec.ReplacedBy,
+	}
+}
+
+func (s *Server) loadTokenRecord(key string) (*tokenRecord, error) {
+	v, err := s.stor.Load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &tokenRecord{}
+	err = json.Unmarshal([]byte(v), rec)
+	if err != nil {
+		return nil, err
+	}
+	if rec.ImpersonateInfo == nil {
+		// Older tokens store the bare ImpersonateInfo
+		ii, err := ImpersonateInfoFromString(v)
+		if err != nil {
+			return nil, err
+		}
+		rec = &tokenRecord{ImpersonateInfo: ii, legacy: true}
+		ttl, err := s.stor.TTL(key)
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			rec.ExpiresAt = time.Now().Add(ttl)
+		}
+	}
+	rec.raw = v
+	return rec, nil
+}
+
+func (s *Server) storeTokenRecord(key string, rec *tokenRecord) error {
+	v, exp := s.encodeTokenRecord(rec)
+	if exp < 0 {
+		return s.stor.Delete(key)
+	}
+	return s.stor.Store(key, v, exp)
+}
+
+// encodeTokenRecord returns the stored form of rec and how long to keep
+// it, negative if it has already expired
+func (s *Server) encodeTokenRecord(rec *tokenRecord) (string, time.Duration) {
+	s.extras.Apply(rec.ImpersonateInfo)
+	v, err := json.Marshal(rec)
+	if err != nil {
+		panic(err)
+	}
+	if rec.ExpiresAt.IsZero() {
+		return string(v), 0
+	}
+	exp := time.Until(rec.ExpiresAt)
+	if exp <= 0 {
+		return "", -1
+	}
+	return string(v), exp
 }
 
 func (s *Server) getToken(token string) (*ImpersonateInfo, error) {
-	iiStr, err := s.stor.Load(token)
+	key := tokenKey(token)
+	rec, err := s.loadTokenRecord(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return ImpersonateInfoFromString(iiStr)
+	// Records are rewritten in the current format on first use. The write
+	// must not bring back a token that was deleted or changed meanwhile.
+	if rec.legacy || time.Since(rec.LastUsedAt) > tokenLastUsedInterval {
+		rec.LastUsedAt = time.Now()
+		v, exp := s.encodeTokenRecord(rec)
+		if exp >= 0 {
+			_, err = s.stor.CompareAndStore(key, rec.raw, v, exp)
+			if err != nil {
+				log.Println("Failed to update token last used time:", err)
+			}
+		}
+	}
+
+	// Tokens stored before the policy changed may still carry other extras
+	s.extras.Apply(rec.ImpersonateInfo)
+	rec.ImpersonateInfo.scope = rec.Scope
+	return rec.ImpersonateInfo, nil
 }
 
-func (s *Server) setToken(token string, ii *ImpersonateInfo) error {
-	return s.stor.Store(token, ii.String(), *s.conf.TokenExpiration)
+func (s *Server) deleteToken(key string) error {
+	return s.stor.Delete(key)
 }
 
-func (s *Server) deleteToken(token string) error {
-	return s.stor.Delete(token)
+var ErrTooManyTokens = errors.New("too many tokens")
+
+// mintToken creates and stores a new sk: token from rec, filling in its
+// creation and expiry times; ttl must have been resolved by the TTL policy
+func (s *Server) mintToken(uid string, rec *tokenRecord, ttl time.Duration) (string, error) {
+	tokens, err := s.listTokens(uid) // Check if the user has too many tokens
+	if err != nil {
+		return "", err
+	}
+
+	if len(tokens) >= *s.conf.TokenCountMax {
+		return "", ErrTooManyTokens
+	}
+
+	rec.CreatedAt = time.Now()
+	rec.ExpiresAt = rec.CreatedAt.Add(ttl)
+	return s.storeNewToken(uid, rec)
 }
 
+// storeNewToken stores rec under a freshly generated token
+func (s *Server) storeNewToken(uid string, rec *tokenRecord) (string, error) {
+	token := s.generateToken(uid)
+	rec.Hint = maskToken(token)
+	err := s.storeTokenRecord(tokenKey(token), rec)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// listTokens returns the storage keys of uid's tokens, or of all tokens
 func (s *Server) listTokens(uid string) ([]string, error) {
-	prefix := "sk:"
-	if uid != "" {
-		prefix += uid + ":"
+	if uid == "" {
+		return s.stor.List(tokenKeyPrefix)
 	}
-	return s.stor.List(prefix)
+	return s.listUserKeys(tokenKeyPrefix, uid)
 }
 
-func (s *Server) initToken() {
+// listUserKeys lists the <prefix><uid>:<id> keys of exactly this uid. UIDs
+// may contain ":", so the plain prefix would also match those of uid:x.
+func (s *Server) listUserKeys(prefix string, uid string) ([]string, error) {
+	keys, err := s.stor.List(prefix + uid + ":")
+	if err != nil {
+		return nil, err
+	}
+	owned := keys[:0]
+	for _, key := range keys {
+		if key[len(prefix):strings.LastIndex(key, ":")] == uid {
+			owned = append(owned, key)
+		}
+	}
+	return owned, nil
+}
+
+// findToken resolves a token ID, or the token itself, among uid's tokens
+// and returns its storage key
+func (s *Server) findToken(uid string, id string) (string, error) {
+	if strings.HasPrefix(id, tokenPrefix) {
+		id = tokenID(tokenKey(id))
+	}
+	keys, err := s.listTokens(uid)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if tokenID(key) == id {
+			return key, nil
+		}
+	}
+	return "", ErrTokenNotFound
+}
+
+// migrateTokens moves tokens stored under their plaintext value to their
+// hashed key, keeping their remaining lifetime
+func (s *Server) migrateTokens() error {
+	tokens, err := s.stor.List(tokenPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		rec, err := s.loadTokenRecord(token)
+		if err == ErrTokenNotFound {
+			continue // Expired meanwhile
+		}
+		if err != nil {
+			return fmt.Errorf("failed to migrate token %s: %w", maskToken(token), err)
+		}
+		rec.Hint = maskToken(token)
+
+		err = s.storeTokenRecord(tokenKey(token), rec)
+		if err != nil {
+			return err
+		}
+		err = s.stor.Delete(token)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(tokens) > 0 {
+		log.Println("Migrated", len(tokens), "tokens to hashed storage")
+	}
+	return nil
+}
+
+// clientIP prefers the address reported by a fronting proxy
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		ip, _, _ := strings.Cut(xff, ",")
+		return strings.TrimSpace(ip)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) initToken() error {
+	err := s.migrateTokens()
+	if err != nil {
+		return err
+	}
+
 	s.kubeconfigTemplate = template.Must(
 		template.ParseFiles(*s.conf.KubeconfigTemplatePath),
 	)
 
 	s.mux.HandleFunc("/_/tokens", s.handleToken)
 	s.mux.HandleFunc("/_/tokens/", s.handleToken)
+	return nil
 }
 
 func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
-	ii, err := s.authenticate(r)
-	if err != nil {
-		http.Error(w, "Failed to authenticate", http.StatusUnauthorized)
-	}
-	uid := ii.UID
-	if uid == "" {
-		uid = ii.Username
+	ii, uid, ok := s.authenticateUser(w, r)
+	if !ok {
+		return
 	}
 	if uid == "" {
 		http.Error(w, "Failed to get UID", http.StatusInternalServerError)
 		return
 	}
+	s.serveTokens(w, r, ii, uid, strings.TrimPrefix(r.URL.Path, "/_/tokens"))
+}
+
+// serveTokens handles the token API of uid below path, which is "" or
+// "/<id>[/action]"; ii is nil when an admin manages another user's tokens
+func (s *Server) serveTokens(w http.ResponseWriter, r *http.Request, ii *ImpersonateInfo, uid string, path string) {
+	path = strings.TrimSuffix(path, "/")
 	switch r.Method {
 	case http.MethodGet:
-		s.handleGetToken(w, r, uid)
+		if strings.HasSuffix(path, "/kubeconfig") {
+			s.handleGetTokenKubeconfig(w, uid, strings.TrimSuffix(path, "/kubeconfig"))
+			return
+		}
+		s.handleGetToken(w, r, uid, path)
 	case http.MethodPost:
-		s.handlePostToken(w, ii, uid)
+		if strings.HasSuffix(path, "/renew") {
+			s.handleRenewToken(w, r, uid, strings.TrimSuffix(path, "/renew"))
+			return
+		}
+		// Admins may not rotate, which would hand them the user's secret
+		if strings.HasSuffix(path, "/rotate") && ii != nil {
+			s.handleRotateToken(w, uid, strings.TrimSuffix(path, "/rotate"))
+			return
+		}
+		if path != "" || ii == nil {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handlePostToken(w, r, ii, uid)
 	case http.MethodDelete:
-		s.handleDeleteToken(w, r)
+		s.handleDeleteToken(w, uid, path)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleGetTokenKubeconfig(w http.ResponseWriter, r *http.Request, uid string) {
-	token := r.URL.Path[len("/_/tokens"):]
-	if token == "" || token == "/" {
+// loadOwnedToken resolves "/<id>" to a token of uid, checking the owner
+// recorded with the token as well as its key
+func (s *Server) loadOwnedToken(w http.ResponseWriter, uid string, path string) (string, *tokenRecord, bool) {
+	id := strings.TrimPrefix(path, "/")
+	if id == "" || strings.Contains(id, "/") {
 		http.Error(w, "No token provided", http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	key, err := s.findToken(uid, id)
+	var rec *tokenRecord
+	if err == nil {
+		rec, err = s.loadTokenRecord(key)
+	}
+	if err == nil && impersonateInfoUID(rec.ImpersonateInfo) != uid {
+		err = ErrTokenNotFound
+	}
+	if err == ErrTokenNotFound {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return "", nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to load token", http.StatusInternalServerError)
+		return "", nil, false
 	}
+	return key, rec, true
+}
 
-	token = token[1:] // Remove leading slash
-	token = strings.TrimSuffix(token, "/kubeconfig")
+// handleGetTokenKubeconfig needs the token itself in the path, as only
+// its hash is stored
+func (s *Server) handleGetTokenKubeconfig(w http.ResponseWriter, uid string, path string) {
+	token := strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(token, tokenPrefix) {
+		http.Error(w, "A kubeconfig can only be rendered for the token itself", http.StatusBadRequest)
+		return
+	}
+	if _, _, ok := s.loadOwnedToken(w, uid, path); !ok {
+		return
+	}
 
 	vars := struct {
 		Username string
@@ -97,9 +431,83 @@ func (s *Server) handleGetTokenKubeconfig(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request, uid string) {
-	if strings.HasSuffix(r.URL.Path, "/kubeconfig") {
-		s.handleGetTokenKubeconfig(w, r, uid)
+func sortTokenInfos(infos []*tokenInfo, field string, desc bool) bool {
+	timeOf := func(t *time.Time) time.Time {
+		if t == nil {
+			return time.Time{}
+		}
+		return *t
+	}
+
+	var cmp func(a, b *tokenInfo) int
+	switch field {
+	case "name":
+		cmp = func(a, b *tokenInfo) int { return strings.Compare(a.Name, b.Name) }
+	case "createdAt":
+		cmp = func(a, b *tokenInfo) int { return timeOf(a.CreatedAt).Compare(timeOf(b.CreatedAt)) }
+	case "expiresAt":
+		cmp = func(a, b *tokenInfo) int { return timeOf(a.ExpiresAt).Compare(timeOf(b.ExpiresAt)) }
+	case "lastUsedAt":
+		cmp = func(a, b *tokenInfo) int { return timeOf(a.LastUsedAt).Compare(timeOf(b.LastUsedAt)) }
+	default:
+		return false
+	}
+
+	slices.SortStableFunc(infos, func(a, b *tokenInfo) int {
+		if c := cmp(a, b); c != 0 {
+			if desc {
+				return -c
+			}
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return true
+}
+
+// handleGetToken lists the user's tokens, sorted by ?sort=name|createdAt|
+// expiresAt|lastUsedAt and ?order=asc|desc, paged by ?offset= and ?limit=
+func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request, uid string, path string) {
+	if path != "" {
+		key, rec, ok := s.loadOwnedToken(w, uid, path)
+		if !ok {
+			return
+		}
+		resp, err := json.Marshal(rec.info(key))
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resp)
+		return
+	}
+
+	q := r.URL.Query()
+	offset, limit := 0, tokenPageDefault
+	var err error
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > tokenPageMax {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	sortField := q.Get("sort")
+	if sortField == "" {
+		sortField = "createdAt"
+	}
+	order := q.Get("order")
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		http.Error(w, "Invalid order", http.StatusBadRequest)
 		return
 	}
 
@@ -109,14 +517,29 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request, uid stri
 		return
 	}
 
-	if tokens == nil {
-		tokens = []string{}
+	infos := make([]*tokenInfo, 0, len(tokens))
+	for _, key := range tokens {
+		rec, err := s.loadTokenRecord(key)
+		if err != nil {
+			continue // Expired since listing
+		}
+		infos = append(infos, rec.info(key))
+	}
+
+	if !sortTokenInfos(infos, sortField, order == "desc") {
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
 	}
 
+	total := len(infos)
+	infos = infos[min(offset, total):min(offset+limit, total)]
+
 	resp, err := json.Marshal(struct {
-		Tokens []string `json:"tokens"`
+		Tokens []*tokenInfo `json:"tokens"`
+		Total  int          `json:"total"`
 	}{
-		Tokens: tokens,
+		Tokens: infos,
+		Total:  total,
 	})
 	if err != nil {
 		panic(err)
@@ -125,39 +548,86 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request, uid stri
 	w.Write(resp)
 }
 
-func (s *Server) handlePostToken(w http.ResponseWriter, ii *ImpersonateInfo, uid string) {
-	tokens, err := s.listTokens(uid) // Check if the user has too many tokens
+func (s *Server) handlePostToken(w http.ResponseWriter, r *http.Request, ii *ImpersonateInfo, uid string) {
+	req := struct {
+		Name  string      `json:"name"`
+		Scope *tokenScope `json:"scope"`
+		TTL   string      `json:"ttl"`
+	}{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Name) > tokenNameMaxLength {
+		http.Error(w, "Token name too long", http.StatusBadRequest)
+		return
+	}
+	if req.Scope != nil {
+		if err := req.Scope.Validate(); err != nil {
+			http.Error(w, "Invalid scope: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Scope.IsEmpty() {
+			req.Scope = nil
+		}
+	}
+
+	ttl, err := parseTTL(req.TTL)
+	if err == nil {
+		ttl, err = s.tokenTTL.Resolve(ii, ttl)
+	}
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+		http.Error(w, "Invalid TTL: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if len(tokens) >= *s.conf.TokenCountMax {
+	rec := &tokenRecord{
+		ImpersonateInfo: ii,
+		Name:            req.Name,
+		CreatorIP:       clientIP(r),
+		Scope:           req.Scope,
+	}
+	token, err := s.mintToken(uid, rec, ttl)
+	if err == ErrTooManyTokens {
 		http.Error(w, "Too many tokens", http.StatusForbidden)
 		return
 	}
-
-	token := s.generateToken(uid)
-	err = s.setToken(token, ii)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Failed to set token", http.StatusInternalServerError)
 		return
 	}
 
-	w.Write([]byte("{\"token\":\"" + token + "\"}\n"))
+	writeTokenSecret(w, rec, token)
 }
 
-func (s *Server) handleDeleteToken(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Path[len("/_/tokens"):]
-	if token == "" || token == "/" {
-		http.Error(w, "No token provided", http.StatusBadRequest)
-		return
+// writeTokenSecret writes the only responses that carry the secret, those
+// creating a token
+func writeTokenSecret(w http.ResponseWriter, rec *tokenRecord, token string) {
+	resp, err := json.Marshal(struct {
+		*tokenInfo
+		Token string `json:"token"`
+	}{
+		tokenInfo: rec.info(tokenKey(token)),
+		Token:     token,
+	})
+	if err != nil {
+		panic(err)
 	}
 
-	token = token[1:] // Remove leading slash
+	w.Write(resp)
+}
 
-	err := s.deleteToken(token)
+func (s *Server) handleDeleteToken(w http.ResponseWriter, uid string, path string) {
+	key, _, ok := s.loadOwnedToken(w, uid, path)
+	if !ok {
+		return
+	}
+
+	err := s.deleteToken(key)
 	if err != nil {
 		http.Error(w, "Failed to delete token", http.StatusInternalServerError)
 		return
@@ -165,3 +635,103 @@ func (s *Server) handleDeleteToken(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("{\"status\":\"success\"}\n"))
 }
+
+// handleRenewToken moves the expiry of an existing token to now plus the
+// requested TTL, within the cap for the identity the token carries
+func (s *Server) handleRenewToken(w http.ResponseWriter, r *http.Request, uid string, path string) {
+	req := struct {
+		TTL string `json:"ttl"`
+	}{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, rec, ok := s.loadOwnedToken(w, uid, path)
+	if !ok {
+		return
+	}
+	if rec.ReplacedBy != "" {
+		http.Error(w, "Token was rotated and cannot be renewed", http.StatusConflict)
+		return
+	}
+
+	ttl, err := parseTTL(req.TTL)
+	if err == nil {
+		ttl, err = s.tokenTTL.Resolve(rec.ImpersonateInfo, ttl)
+	}
+	if err != nil {
+		http.Error(w, "Invalid TTL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rec.ExpiresAt = time.Now().Add(ttl)
+	err = s.storeTokenRecord(key, rec)
+	if err != nil {
+		log.Println("Failed to renew token:", err)
+		http.Error(w, "Failed to renew token", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(rec.info(key))
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resp)
+}
+
+// handleRotateToken issues a new secret carrying the name, scope and
+// expiry of an existing token. The old secret keeps working for the
+// rotation grace period.
+func (s *Server) handleRotateToken(w http.ResponseWriter, uid string, path string) {
+	key, rec, ok := s.loadOwnedToken(w, uid, path)
+	if !ok {
+		return
+	}
+	if rec.ReplacedBy != "" {
+		http.Error(w, "Token was already rotated", http.StatusConflict)
+		return
+	}
+
+	tokens, err := s.listTokens(uid)
+	if err != nil {
+		log.Println("Failed to list tokens:", err)
+		http.Error(w, "Failed to rotate token", http.StatusInternalServerError)
+		return
+	}
+	if len(tokens) >= *s.conf.TokenCountMax {
+		http.Error(w, "Too many tokens", http.StatusForbidden)
+		return
+	}
+
+	newRec := *rec
+	newRec.LastUsedAt = time.Time{}
+	newRec.legacy = false
+	newRec.raw = ""
+	token, err := s.storeNewToken(uid, &newRec)
+	if err != nil {
+		log.Println("Failed to rotate token:", err)
+		http.Error(w, "Failed to rotate token", http.StatusInternalServerError)
+		return
+	}
+
+	rec.ReplacedBy = tokenID(tokenKey(token))
+	if graceEnd := time.Now().Add(*s.conf.TokenRotationGrace); rec.ExpiresAt.IsZero() || graceEnd.Before(rec.ExpiresAt) {
+		rec.ExpiresAt = graceEnd
+	}
+	if *s.conf.TokenRotationGrace <= 0 {
+		err = s.deleteToken(key)
+	} else {
+		err = s.storeTokenRecord(key, rec)
+	}
+	if err != nil {
+		log.Println("Failed to expire rotated token:", err)
+		http.Error(w, "Failed to expire rotated token", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokenSecret(w, &newRec, token)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/utils"
+)
+
+const staticTokenFileCheckInterval = 10 * time.Second
+
+const staticTokenHashPrefix = "sha256:"
+
+// StaticTokenFile authenticates tokens listed in a kube-apiserver style
+// CSV file of token,user,uid,"group1,group2". Tokens may be given as
+// sha256:<hex> instead of plaintext. The file is reloaded when it changes.
+type StaticTokenFile struct {
+	path string
+
+	// tokens is keyed by the hex SHA-256 of the token
+	tokens  map[string]*ImpersonateInfo
+	modTime time.Time
+
+	timer *time.Ticker
+	lock  *sync.RWMutex
+}
+
+func NewStaticTokenFile(path string) (*StaticTokenFile, error) {
+	tf := &StaticTokenFile{
+		path:  path,
+		timer: time.NewTicker(staticTokenFileCheckInterval),
+		lock:  &sync.RWMutex{},
+	}
+
+	err := tf.reload()
+	if err != nil {
+		return nil, err
+	}
+	go tf.updateLoop()
+
+	return tf, nil
+}
+
+func (tf *StaticTokenFile) updateLoop() {
+	for range tf.timer.C {
+		fi, err := os.Stat(tf.path)
+		if err != nil {
+			log.Println("Failed to stat token file:", err)
+			continue
+		}
+
+		tf.lock.RLock()
+		changed := !fi.ModTime().Equal(tf.modTime)
+		tf.lock.RUnlock()
+		if !changed {
+			continue
+		}
+
+		err = tf.reload()
+		if err != nil {
+			log.Println("Failed to reload token file, keeping previous tokens:", err)
+			continue
+		}
+		log.Println("Reloaded token file", tf.path)
+	}
+}
+
+func (tf *StaticTokenFile) reload() error {
+	f, err := os.Open(tf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	tokens, err := parseStaticTokens(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tf.path, err)
+	}
+
+	tf.lock.Lock()
+	tf.tokens = tokens
+	tf.modTime = fi.ModTime()
+	tf.lock.Unlock()
+
+	return nil
+}
+
+func parseStaticTokens(r io.Reader) (map[string]*ImpersonateInfo, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	tokens := make(map[string]*ImpersonateInfo)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected token,user,uid[,groups]", line)
+		}
+
+		token, user, uid := record[0], record[1], record[2]
+		if token == "" || user == "" {
+			return nil, fmt.Errorf("line %d: token and user must not be empty", line)
+		}
+
+		key := utils.HashToken(token)
+		if strings.HasPrefix(token, staticTokenHashPrefix) {
+			key = strings.ToLower(token[len(staticTokenHashPrefix):])
+		}
+		if _, ok := tokens[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate token", line)
+		}
+
+		ii := &ImpersonateInfo{
+			UID:      uid,
+			Username: user,
+			Group:    []string{},
+		}
+		if len(record) > 3 {
+			for _, g := range strings.Split(record[3], ",") {
+				if g = strings.TrimSpace(g); g != "" {
+					ii.Group = append(ii.Group, g)
+				}
+			}
+		}
+		tokens[key] = ii
+	}
+
+	return tokens, nil
+}
+
+func (tf *StaticTokenFile) Lookup(token string) (*ImpersonateInfo, bool) {
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+
+	ii, ok := tf.tokens[utils.HashToken(token)]
+	if !ok {
+		return nil, false
+	}
+
+	// Hand out a copy so callers cannot modify the shared entry
+	cp := *ii
+	cp.Group = append([]string{}, ii.Group...)
+	return &cp, true
+}
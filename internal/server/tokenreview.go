@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func (s *Server) initTokenReview() error {
+	// The endpoint resolves any token it is given, so never leave it open
+	if *s.conf.TokenReviewClients == "" && (*s.conf.TLSClientCAFile == "" || *s.conf.TLSCertFile == "") {
+		return errors.New("-tokenreview needs -tokenreview-clients or TLS client certificates (-tls-client-ca-file)")
+	}
+	s.mux.HandleFunc("/_/tokenreview", s.handleTokenReview)
+	return nil
+}
+
+// tokenReviewCaller identifies the caller by client certificate or static
+// token file only. OAuth users and their sk: tokens share the username
+// namespace, so any of them could otherwise claim a listed client's name.
+func (s *Server) tokenReviewCaller(r *http.Request) *ImpersonateInfo {
+	if ii := clientCertImpersonateInfo(r); ii != nil {
+		return ii
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.tokenFile == nil {
+		return nil
+	}
+	ii, ok := s.tokenFile.Lookup(token)
+	if !ok {
+		return nil
+	}
+	return ii
+}
+
+// handleTokenReview implements the apiserver's webhook token authentication
+// protocol on top of the proxy's own token resolution
+func (s *Server) handleTokenReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Without a client list any verified client certificate is trusted
+	caller := s.tokenReviewCaller(r)
+	if caller == nil || (*s.conf.TokenReviewClients != "" &&
+		!slices.Contains(strings.Split(*s.conf.TokenReviewClients, ","), caller.Username)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	review := &authenticationv1.TokenReview{}
+	err := json.NewDecoder(r.Body).Decode(review)
+	if err != nil {
+		http.Error(w, "Failed to decode TokenReview", http.StatusBadRequest)
+		return
+	}
+
+	resp := &authenticationv1.TokenReview{}
+	resp.APIVersion = authenticationv1.SchemeGroupVersion.String()
+	resp.Kind = "TokenReview"
+
+	ii, err := s.authenticateToken(review.Spec.Token)
+	if err == nil {
+		err = s.checkBan(ii)
+	}
+	if err == nil && ii.scope != nil {
+		// the apiserver cannot enforce our scopes, so don't vouch for them
+		err = errors.New("scoped tokens cannot be used with TokenReview")
+	}
+	if err != nil {
+		resp.Status.Error = err.Error()
+	} else {
+		resp.Status.Authenticated = true
+		resp.Status.User = authenticationv1.UserInfo{
+			Username: ii.Username,
+			UID:      ii.UID,
+			Groups:   ii.Group,
+			Extra:    make(map[string]authenticationv1.ExtraValue, len(ii.Extra)),
+		}
+		for k, vv := range ii.Extra {
+			resp.Status.User.Extra[strings.ToLower(k)] = vv
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -13,11 +13,20 @@ import (
 )
 
 type TokenStorage interface {
+	// Store keeps the value for exp, or indefinitely if exp is not positive
 	Store(key string, value string, exp time.Duration) error
+	// CompareAndStore replaces the value only if the key still holds old,
+	// reporting whether it did
+	CompareAndStore(key string, old string, value string, exp time.Duration) (bool, error)
 	Load(key string) (string, error)
+	// LoadAndDelete removes the key and returns the value it held, so that
+	// only one caller can claim it
+	LoadAndDelete(key string) (string, error)
 	Delete(key string) error
 	Exists(key string) (bool, error)
 	List(prefix string) ([]string, error)
+	// TTL returns the remaining lifetime of the key, 0 if it never expires
+	TTL(key string) (time.Duration, error)
 }
 
 var tokenStorages = make(map[string](func(string) (TokenStorage, error)))
@@ -43,6 +52,12 @@ type TokenStorageMemory struct {
 	data *sync.Map
 }
 
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time
+	timer     *time.Timer
+}
+
 func NewTokenStorageMemory(string) (TokenStorage, error) {
 	return &TokenStorageMemory{
 		data: &sync.Map{},
@@ -50,26 +65,84 @@ func NewTokenStorageMemory(string) (TokenStorage, error) {
 }
 
 func (ts *TokenStorageMemory) Store(key string, value string, exp time.Duration) error {
-	ts.data.Store(key, value)
-	time.AfterFunc(exp, func() {
-		ts.Delete(key)
-	})
+	e := &memoryEntry{value: value}
+	if exp > 0 {
+		e.expiresAt = time.Now().Add(exp)
+		e.timer = time.AfterFunc(exp, func() {
+			// Only remove the entry this timer belongs to
+			ts.data.CompareAndDelete(key, e)
+		})
+	}
+
+	if old, ok := ts.data.Swap(key, e); ok && old.(*memoryEntry).timer != nil {
+		old.(*memoryEntry).timer.Stop()
+	}
 	return nil
 }
 
+func (ts *TokenStorageMemory) CompareAndStore(key string, old string, value string, exp time.Duration) (bool, error) {
+	v, ok := ts.data.Load(key)
+	if !ok || v.(*memoryEntry).value != old {
+		return false, nil
+	}
+
+	e := &memoryEntry{value: value}
+	if exp > 0 {
+		e.expiresAt = time.Now().Add(exp)
+		e.timer = time.AfterFunc(exp, func() {
+			ts.data.CompareAndDelete(key, e)
+		})
+	}
+	if !ts.data.CompareAndSwap(key, v, e) {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		return false, nil
+	}
+	if t := v.(*memoryEntry).timer; t != nil {
+		t.Stop()
+	}
+	return true, nil
+}
+
 func (ts *TokenStorageMemory) Load(key string) (string, error) {
 	v, ok := ts.data.Load(key)
 	if !ok {
 		return "", ErrTokenNotFound
 	}
-	return v.(string), nil
+	return v.(*memoryEntry).value, nil
+}
+
+func (ts *TokenStorageMemory) LoadAndDelete(key string) (string, error) {
+	v, ok := ts.data.LoadAndDelete(key)
+	if !ok {
+		return "", ErrTokenNotFound
+	}
+	if t := v.(*memoryEntry).timer; t != nil {
+		t.Stop()
+	}
+	return v.(*memoryEntry).value, nil
 }
 
 func (ts *TokenStorageMemory) Delete(key string) error {
-	ts.data.Delete(key)
+	if old, ok := ts.data.LoadAndDelete(key); ok && old.(*memoryEntry).timer != nil {
+		old.(*memoryEntry).timer.Stop()
+	}
 	return nil
 }
 
+func (ts *TokenStorageMemory) TTL(key string) (time.Duration, error) {
+	v, ok := ts.data.Load(key)
+	if !ok {
+		return 0, ErrTokenNotFound
+	}
+	e := v.(*memoryEntry)
+	if e.expiresAt.IsZero() {
+		return 0, nil
+	}
+	return time.Until(e.expiresAt), nil
+}
+
 func (ts *TokenStorageMemory) Exists(key string) (bool, error) {
 	_, ok := ts.data.Load(key)
 	return ok, nil
@@ -116,6 +189,31 @@ func (ts *TokenStorageRedis) Store(key string, value string, exp time.Duration)
 	return ts.client.Set(context.Background(), ts.prefix+key, value, exp).Err()
 }
 
+func (ts *TokenStorageRedis) CompareAndStore(key string, old string, value string, exp time.Duration) (bool, error) {
+	ctx := context.Background()
+	key = ts.prefix + key
+	stored := false
+	err := ts.client.Watch(ctx, func(tx *redis.Tx) error {
+		v, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil || (err == nil && v != old) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, value, exp)
+			return nil
+		})
+		stored = err == nil
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return stored, err
+}
+
 func (ts *TokenStorageRedis) Load(key string) (string, error) {
 	v, err := ts.client.Get(context.Background(), ts.prefix+key).Result()
 	if err == redis.Nil {
@@ -124,10 +222,33 @@ func (ts *TokenStorageRedis) Load(key string) (string, error) {
 	return v, err
 }
 
+func (ts *TokenStorageRedis) LoadAndDelete(key string) (string, error) {
+	v, err := ts.client.GetDel(context.Background(), ts.prefix+key).Result()
+	if err == redis.Nil {
+		return "", ErrTokenNotFound
+	}
+	return v, err
+}
+
 func (ts *TokenStorageRedis) Delete(key string) error {
 	return ts.client.Del(context.Background(), ts.prefix+key).Err()
 }
 
+func (ts *TokenStorageRedis) TTL(key string) (time.Duration, error) {
+	ttl, err := ts.client.TTL(context.Background(), ts.prefix+key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// -2 means the key does not exist, -1 that it has no expiry
+	if ttl == -2 {
+		return 0, ErrTokenNotFound
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
 func (ts *TokenStorageRedis) Exists(key string) (bool, error) {
 	_, err := ts.client.Get(context.Background(), ts.prefix+key).Result()
 	if err == redis.Nil {
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/kube-auth-proxy/internal/config"
+)
+
+const tokenTTLMin = time.Minute
+
+var ErrTokenTTLTooLong = errors.New("requested TTL exceeds the maximum")
+
+// tokenTTLPolicy caps token lifetimes per group. A user's cap is the
+// largest among their groups, else the "*" entry, else the default TTL.
+type tokenTTLPolicy struct {
+	def time.Duration
+	max map[string]time.Duration
+}
+
+func newTokenTTLPolicy(conf *config.ServerConfig) (*tokenTTLPolicy, error) {
+	p := &tokenTTLPolicy{
+		def: *conf.TokenExpiration,
+		max: make(map[string]time.Duration),
+	}
+	for _, entry := range strings.Split(*conf.TokenExpirationMax, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		group, d, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid token expiration maximum %q, expected group=duration", entry)
+		}
+		ttl, err := time.ParseDuration(d)
+		if err != nil || ttl < tokenTTLMin {
+			return nil, fmt.Errorf("invalid token expiration maximum %q", entry)
+		}
+		p.max[strings.TrimSpace(group)] = ttl
+	}
+	return p, nil
+}
+
+func (p *tokenTTLPolicy) Max(ii *ImpersonateInfo) time.Duration {
+	var max time.Duration
+	for _, g := range ii.Group {
+		if d, ok := p.max[g]; ok && d > max {
+			max = d
+		}
+	}
+	if max > 0 {
+		return max
+	}
+	if d, ok := p.max["*"]; ok {
+		return d
+	}
+	return p.def
+}
+
+// Resolve validates a requested TTL, a zero request means the default
+// within the user's cap
+func (p *tokenTTLPolicy) Resolve(ii *ImpersonateInfo, requested time.Duration) (time.Duration, error) {
+	max := p.Max(ii)
+	if requested == 0 {
+		return min(p.def, max), nil
+	}
+	if requested < tokenTTLMin {
+		return 0, fmt.Errorf("requested TTL is shorter than %s", tokenTTLMin)
+	}
+	if requested > max {
+		return 0, fmt.Errorf("%w of %s", ErrTokenTTLTooLong, max)
+	}
+	return requested, nil
+}
+
+// parseTTL accepts a Go duration such as "1h" or "720h", empty for none
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
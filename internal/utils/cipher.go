@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+var ErrCiphertextInvalid = errors.New("invalid ciphertext")
+
+// Cipher encrypts values at rest with AES-256-GCM
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher derives the encryption key from secret, so the same secret may
+// also be used for signing
+func NewCipher(secret []byte) *Cipher {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("kube-auth-proxy encryption key"))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &Cipher{aead: aead}
+}
+
+// NewRandomCipher creates a cipher with an ephemeral key, values it
+// encrypts cannot be decrypted after the process restarts
+func NewRandomCipher() *Cipher {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return NewCipher(key)
+}
+
+func (c *Cipher) Encrypt(plaintext []byte) string {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawStdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plaintext, nil))
+}
+
+func (c *Cipher) Decrypt(str string) ([]byte, error) {
+	b, err := base64.RawStdEncoding.DecodeString(str)
+	if err != nil || len(b) < c.aead.NonceSize() {
+		return nil, ErrCiphertextInvalid
+	}
+	plaintext, err := c.aead.Open(nil, b[:c.aead.NonceSize()], b[c.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrCiphertextInvalid
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,414 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum interval between refreshes triggered by unknown key IDs
+const jwksMinRefreshInterval = 30 * time.Second
+
+// Timeout for fetching the key set
+const jwksFetchTimeout = 10 * time.Second
+
+// Allowed clock skew when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+var (
+	ErrJWTMalformed        = errors.New("malformed jwt")
+	ErrJWTUnsupportedAlg   = errors.New("unsupported jwt algorithm")
+	ErrJWTKeyNotFound      = errors.New("jwt signing key not found")
+	ErrJWTInvalidSignature = errors.New("invalid jwt signature")
+	ErrJWTExpired          = errors.New("jwt expired")
+	ErrJWTNotYetValid      = errors.New("jwt not yet valid")
+	ErrJWTInvalidIssuer    = errors.New("invalid jwt issuer")
+	ErrJWTInvalidAudience  = errors.New("invalid jwt audience")
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWKS is a JSON Web Key Set fetched from url and refreshed periodically
+type JWKS struct {
+	url    string
+	client *http.Client
+
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+
+	timer *time.Ticker
+	lock  *sync.RWMutex
+}
+
+func NewJWKS(url string, refresh time.Duration) *JWKS {
+	ks := &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		keys:   make(map[string]crypto.PublicKey),
+		timer:  time.NewTicker(refresh),
+		lock:   &sync.RWMutex{},
+	}
+
+	ks.startUpdateLoop()
+
+	return ks
+}
+
+func (ks *JWKS) startUpdateLoop() {
+	err := ks.Refresh()
+	if err != nil {
+		log.Println("Failed to fetch JWKS:", err)
+	}
+	go ks.updateLoop()
+}
+
+func (ks *JWKS) updateLoop() {
+	for range ks.timer.C {
+		err := ks.Refresh()
+		if err != nil {
+			log.Println("Failed to refresh JWKS:", err)
+		}
+	}
+}
+
+// Refresh fetches the key set; keys are kept unchanged on failure
+func (ks *JWKS) Refresh() error {
+	ks.lock.Lock()
+	ks.lastRefresh = time.Now()
+	ks.lock.Unlock()
+
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching jwks: %s", resp.Status)
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWK %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	ks.lock.Lock()
+	ks.keys = keys
+	ks.lock.Unlock()
+
+	return nil
+}
+
+// Key returns the key with the given ID, refreshing the set once if it is unknown
+func (ks *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	ks.lock.RLock()
+	pub, ok := ks.lookup(kid)
+	last := ks.lastRefresh
+	ks.lock.RUnlock()
+	if ok {
+		return pub, nil
+	}
+
+	if time.Since(last) < jwksMinRefreshInterval {
+		return nil, ErrJWTKeyNotFound
+	}
+
+	err := ks.Refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	pub, ok = ks.lookup(kid)
+	if !ok {
+		return nil, ErrJWTKeyNotFound
+	}
+	return pub, nil
+}
+
+// lookup must be called with the lock held
+func (ks *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	pub, ok := ks.keys[kid]
+	if !ok && kid == "" && len(ks.keys) == 1 {
+		// Tokens without a key ID are accepted when the set has a single key
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	return pub, ok
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// JWTVerifier checks signature, expiry, issuer and audience of JWTs
+type JWTVerifier struct {
+	jwks     *JWKS
+	issuer   string
+	audience string
+}
+
+// NewJWTVerifier creates a verifier; empty issuer or audience skips that check
+func NewJWTVerifier(jwks *JWKS, issuer string, audience string) *JWTVerifier {
+	return &JWTVerifier{
+		jwks:     jwks,
+		issuer:   issuer,
+		audience: audience,
+	}
+}
+
+func (v *JWTVerifier) Verify(tokenString string) (map[string]interface{}, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeJWTSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	pub, err := v.jwks.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyJWTSignature(header.Alg, pub, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	err = decodeJWTSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return ErrJWTExpired
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return ErrJWTExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+			return ErrJWTNotYetValid
+		}
+	}
+
+	if v.issuer != "" {
+		iss, _ := claims["iss"].(string)
+		if iss != v.issuer {
+			return ErrJWTInvalidIssuer
+		}
+	}
+
+	if v.audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud != v.audience {
+				return ErrJWTInvalidAudience
+			}
+		case []interface{}:
+			found := false
+			for _, a := range aud {
+				if a == v.audience {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return ErrJWTInvalidAudience
+			}
+		default:
+			return ErrJWTInvalidAudience
+		}
+	}
+
+	return nil
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrJWTMalformed
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return ErrJWTMalformed
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, pub crypto.PublicKey, signed []byte, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return ErrJWTInvalidSignature
+		}
+		if !ed25519.Verify(key, signed, sig) {
+			return ErrJWTInvalidSignature
+		}
+		return nil
+	default:
+		return ErrJWTUnsupportedAlg
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[0] {
+	case 'R':
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return ErrJWTInvalidSignature
+		}
+	case 'P':
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(key, hash, digest, sig, nil) != nil {
+			return ErrJWTInvalidSignature
+		}
+	case 'E':
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrJWTInvalidSignature
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrJWTInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return ErrJWTInvalidSignature
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestJWKS(t *testing.T, key *rsa.PrivateKey) *JWKS {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jwk{{
+				Kty: "RSA",
+				Kid: "test",
+				Use: "sig",
+				Alg: "RS256",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return NewJWKS(srv.URL, time.Hour)
+}
+
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewJWTVerifier(newTestJWKS(t, key), "https://issuer.example", "kube-auth-proxy")
+
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://issuer.example",
+			"aud":    "kube-auth-proxy",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"userId": "alice",
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", signTestJWT(t, key, claims(nil)), nil},
+		{"forged signature", signTestJWT(t, forger, claims(nil)), ErrJWTInvalidSignature},
+		{"expired", signTestJWT(t, key, claims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		})), ErrJWTExpired},
+		{"wrong issuer", signTestJWT(t, key, claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example"
+		})), ErrJWTInvalidIssuer},
+		{"wrong audience", signTestJWT(t, key, claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"someone-else"}
+		})), ErrJWTInvalidAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.Verify(tt.token)
+			if err != tt.err {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && c["userId"] != "alice" {
+				t.Fatalf("Verify() claims = %v", c)
+			}
+		})
+	}
+}
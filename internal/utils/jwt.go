@@ -2,26 +2,38 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
 )
 
-func ExtractUIDFromJWT(tokenString string) (string, error) {
+// ExtractClaimsFromJWT decodes the payload of a JWT without verifying it
+func ExtractClaimsFromJWT(tokenString string) (map[string]interface{}, error) {
 	parts := strings.Split(tokenString, ".")
 	if len(parts) != 3 {
-		return "", fmt.Errorf("invalid JWT format")
+		return nil, fmt.Errorf("invalid JWT format")
 	}
 
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return "", fmt.Errorf("failed to decode payload: %v", err)
+		return nil, fmt.Errorf("failed to decode payload: %v", err)
 	}
 
 	var claims map[string]interface{}
 	if err := json.Unmarshal(payload, &claims); err != nil {
-		return "", fmt.Errorf("failed to unmarshal payload: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal payload: %v", err)
+	}
+
+	return claims, nil
+}
+
+func ExtractUIDFromJWT(tokenString string) (string, error) {
+	claims, err := ExtractClaimsFromJWT(tokenString)
+	if err != nil {
+		return "", err
 	}
 
 	sub, ok := claims["userId"].(string)
@@ -65,3 +77,8 @@ func GenerateRandomString(length int, prefix string) string {
 	// Trim the string to the desired length
 	return prefix + randomString[:length]
 }
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
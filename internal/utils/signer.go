@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSignedValueInvalid = errors.New("invalid signed value")
+	ErrSignedValueExpired = errors.New("signed value expired")
+)
+
+// Signer produces tamper-proof, expiring values suitable for cookies
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// NewRandomSigner creates a signer with an ephemeral key, values it signs
+// become invalid when the process restarts
+func NewRandomSigner() *Signer {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return NewSigner(key)
+}
+
+type signedValue struct {
+	Payload json.RawMessage `json:"p"`
+	Expiry  int64           `json:"e"`
+}
+
+func (s *Signer) mac(data string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (s *Signer) Sign(v interface{}, exp time.Duration) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(&signedValue{
+		Payload: payload,
+		Expiry:  time.Now().Add(exp).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(b)
+	return data + "." + s.mac(data), nil
+}
+
+func (s *Signer) Verify(str string, v interface{}) error {
+	data, mac, ok := strings.Cut(str, ".")
+	if !ok {
+		return ErrSignedValueInvalid
+	}
+	if !hmac.Equal([]byte(mac), []byte(s.mac(data))) {
+		return ErrSignedValueInvalid
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return ErrSignedValueInvalid
+	}
+
+	sv := &signedValue{}
+	err = json.Unmarshal(b, sv)
+	if err != nil {
+		return ErrSignedValueInvalid
+	}
+	if time.Now().Unix() > sv.Expiry {
+		return ErrSignedValueExpired
+	}
+
+	return json.Unmarshal(sv.Payload, v)
+}
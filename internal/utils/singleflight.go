@@ -0,0 +1,45 @@
+package utils
+
+import "sync"
+
+type singleflightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// Singleflight collapses concurrent calls with the same key into one
+type Singleflight struct {
+	calls map[string]*singleflightCall
+	lock  *sync.Mutex
+}
+
+func NewSingleflight() *Singleflight {
+	return &Singleflight{
+		calls: make(map[string]*singleflightCall),
+		lock:  &sync.Mutex{},
+	}
+}
+
+func (sf *Singleflight) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	sf.lock.Lock()
+	if c, ok := sf.calls[key]; ok {
+		sf.lock.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &singleflightCall{}
+	c.wg.Add(1)
+	sf.calls[key] = c
+	sf.lock.Unlock()
+
+	defer func() {
+		sf.lock.Lock()
+		delete(sf.calls, key)
+		sf.lock.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -1,5 +1,10 @@
 import { MessagePlugin } from "tdesign-vue-next";
-import { getToken } from "./token";
+import {
+  getActAs,
+  getCsrfToken,
+  hasSession,
+  redirectToLogin,
+} from "./token";
 
 async function sleep(ms: number): Promise<void> {
   return new Promise((resolve) => setTimeout(resolve, ms));
@@ -33,7 +38,8 @@ class Client {
 
     opts.headers = {
       ...opts.headers,
-      Authorization: "Bearer " + getToken(),
+      "X-CSRF-Token": getCsrfToken(),
+      ...(getActAs() ? { "X-Kube-Auth-Proxy-Act-As": getActAs() } : {}),
     };
     try {
       let resp = await fetch(url, opts);
@@ -103,8 +109,8 @@ class Client {
   }
 
   async ensureUsername() {
-    if (!getToken()) {
-      window.location.href = "../oauth/redirect";
+    if (!hasSession()) {
+      redirectToLogin();
       return false;
     }
     if (this.username) return true;
@@ -119,10 +125,14 @@ class Client {
           true,
         )
       ).json();
+      if (userInfo.username === "system:anonymous") {
+        redirectToLogin();
+        return false;
+      }
       this.username = userInfo.username;
     } catch (e) {
       console.error(e);
-      window.location.href = "../oauth/redirect";
+      redirectToLogin();
       return false;
     }
   }
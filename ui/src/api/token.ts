@@ -1,33 +1,42 @@
-import { ref } from "vue";
+const CSRF_COOKIE = "kube_auth_proxy_csrf";
+const LOCAL_STORAGE_ACT_AS_KEY = "kube-auth-proxy-ui-act-as";
 
-const LOCAL_STORAGE_TOKEN_KEY = "kube-auth-proxy-ui-token";
-
-function loadToken() {
-  const token = localStorage.getItem(LOCAL_STORAGE_TOKEN_KEY);
-  if (token) {
-    setToken(token);
+// The session itself lives in an HttpOnly cookie; only the CSRF token,
+// which must be echoed on state-changing requests, is readable here
+export const getCsrfToken = () => {
+  for (const part of document.cookie.split(";")) {
+    const [name, ...value] = part.trim().split("=");
+    if (name === CSRF_COOKIE) {
+      return decodeURIComponent(value.join("="));
+    }
   }
-}
-
-export const token = ref("");
-export const setToken = (newToken: string) => {
-  token.value = newToken;
-  localStorage.setItem(LOCAL_STORAGE_TOKEN_KEY, newToken);
+  return "";
 };
-export const clearToken = () => {
-  token.value = "";
-  localStorage.removeItem(LOCAL_STORAGE_TOKEN_KEY);
+export const hasSession = () => {
+  return getCsrfToken() !== "";
 };
-export const hasToken = () => {
-  return token.value !== "";
+export const logout = async () => {
+  setActAs("");
+  await fetch("../session/logout", {
+    method: "POST",
+    headers: { "X-CSRF-Token": getCsrfToken() },
+  });
+};
+export const redirectToLogin = () => {
+  const returnTo = window.location.hash.replace(/^#/, "") || "/";
+  window.location.href =
+    "../oauth/redirect?return_to=" + encodeURIComponent(returnTo);
 };
-export const useToken = () => {
-  if (!hasToken()) {
-    loadToken();
-  }
 
-  return token;
+// Admins may view the cluster as another user, the proxy audits every
+// request made this way
+export const getActAs = () => {
+  return localStorage.getItem(LOCAL_STORAGE_ACT_AS_KEY) ?? "";
 };
-export const getToken = () => {
-  return useToken().value;
+export const setActAs = (uid: string) => {
+  if (uid) {
+    localStorage.setItem(LOCAL_STORAGE_ACT_AS_KEY, uid);
+  } else {
+    localStorage.removeItem(LOCAL_STORAGE_ACT_AS_KEY);
+  }
 };
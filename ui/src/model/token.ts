@@ -0,0 +1,18 @@
+export interface TokenScope {
+  readOnly?: boolean;
+  verbs?: string[];
+  resources?: string[];
+  namespaces?: string[];
+}
+
+export interface TokenInfo {
+  id: string;
+  token: string; // masked
+  name: string;
+  createdAt: string | null;
+  expiresAt: string | null;
+  lastUsedAt: string | null;
+  creatorIP: string;
+  scope: TokenScope | null;
+  replacedBy?: string; // set on the old token after a rotation
+}
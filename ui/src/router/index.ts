@@ -8,16 +8,16 @@ const router = createRouter({
       name: "home",
       component: () => import("@/views/HomeView.vue"),
     },
-    {
-      path: "/auth/token/:token",
-      name: "auth_token",
-      component: () => import("@/views/AuthTokenView.vue"),
-    },
     {
       path: "/tokens",
       name: "token",
       component: () => import("@/views/TokenView.vue"),
     },
+    {
+      path: "/device",
+      name: "device",
+      component: () => import("@/views/DeviceView.vue"),
+    },
     {
       path: "/logout",
       name: "logout",